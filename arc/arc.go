@@ -0,0 +1,234 @@
+/*
+Adaptive replacement cache (Megiddo & Modha, 2003), measured in bytes.
+
+Entries seen once live in t1, entries seen at least twice live in t2.
+When they are evicted their keys are remembered in the ghost lists b1 and b2.
+A hit in a ghost list tells which of t1 or t2 was evicted too eagerly,
+and the target size p of t1 adapts accordingly.
+*/
+package arc
+
+import (
+	"QECache/eviction"
+	"container/list"
+	"time"
+)
+
+// Simple ARC data structure (dictionary). Not safe for concurrent access
+type ARCDict struct {
+	// Give 0 for assuming infinite capacity
+	maxBytes int64
+	// the target number of bytes for t1
+	p int64
+	// resident entries: recently used once, and frequently used
+	t1, t2 *segment
+	// ghost entries: keys evicted from t1 and t2, without values
+	b1, b2 *segment
+	// every element of the four segments, indexed by key
+	cache map[string]*list.Element
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value eviction.Value)
+	// the clock used to decide expiration. Replaceable for testing
+	now func() time.Time
+}
+
+type entry struct {
+	key    string
+	value  eviction.Value
+	expire time.Time
+	// the bytes the entry takes (or took, for a ghost)
+	size int64
+	// the segment holding the entry
+	seg *segment
+}
+
+// an LRU list keeping track of its bytes
+type segment struct {
+	ll    *list.List
+	bytes int64
+}
+
+func newSegment() *segment {
+	return &segment{ll: list.New()}
+}
+
+func (s *segment) pushFront(e *entry) *list.Element {
+	e.seg = s
+	s.bytes += e.size
+	return s.ll.PushFront(e)
+}
+
+func (s *segment) remove(ele *list.Element) *entry {
+	e := s.ll.Remove(ele).(*entry)
+	s.bytes -= e.size
+	return e
+}
+
+func New(maxBytes int64, onEvicted func(string, eviction.Value)) *ARCDict {
+	return &ARCDict{
+		maxBytes:  maxBytes,
+		t1:        newSegment(),
+		t2:        newSegment(),
+		b1:        newSegment(),
+		b2:        newSegment(),
+		cache:     make(map[string]*list.Element),
+		OnEvicted: onEvicted,
+		now:       time.Now,
+	}
+}
+
+func (c *ARCDict) resident(e *entry) bool {
+	return e.seg == c.t1 || e.seg == c.t2
+}
+
+func (c *ARCDict) Get(key string) (value eviction.Value, ok bool) {
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	e := ele.Value.(*entry)
+	if !c.resident(e) {
+		// a ghost only remembers the key
+		return nil, false
+	}
+	if eviction.Expired(e.expire, c.now()) {
+		c.removeElement(ele)
+		return nil, false
+	}
+
+	// seen at least twice now, so it belongs to t2
+	e.seg.remove(ele)
+	c.cache[key] = c.t2.pushFront(e)
+	return e.value, true
+}
+
+func (c *ARCDict) Add(key string, value eviction.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+func (c *ARCDict) AddWithTTL(key string, value eviction.Value, ttl time.Duration) {
+	e := &entry{
+		key:    key,
+		value:  value,
+		expire: eviction.ExpireAt(c.now(), ttl),
+		size:   int64(len(key)) + int64(value.Len()),
+	}
+
+	ele, ok := c.cache[key]
+	if !ok {
+		// a brand new key
+		c.replace(e.size, false)
+		c.cache[key] = c.t1.pushFront(e)
+		c.trimGhosts()
+		return
+	}
+
+	old := ele.Value.(*entry)
+	old.seg.remove(ele)
+	delete(c.cache, key)
+
+	switch old.seg {
+	case c.b1:
+		// t1 was evicted too early, give it more room
+		c.p = min(c.p+e.size*max(c.b2.bytes/max(c.b1.bytes, 1), 1), c.maxBytes)
+	case c.b2:
+		// t2 was evicted too early, give it more room
+		c.p = max(c.p-e.size*max(c.b1.bytes/max(c.b2.bytes, 1), 1), 0)
+	}
+
+	c.replace(e.size, old.seg == c.b2)
+	c.cache[key] = c.t2.pushFront(e)
+}
+
+// make room for `size` more bytes by moving residents into ghost lists
+func (c *ARCDict) replace(size int64, inB2 bool) {
+	for c.maxBytes != 0 && c.t1.bytes+c.t2.bytes+size > c.maxBytes && c.Len() > 0 {
+		c.evict(inB2)
+	}
+}
+
+func (c *ARCDict) evict(inB2 bool) {
+	from, to := c.t2, c.b2
+	if c.t1.ll.Len() > 0 && (c.t1.bytes > c.p || (inB2 && c.t1.bytes == c.p) || c.t2.ll.Len() == 0) {
+		from, to = c.t1, c.b1
+	}
+
+	e := from.remove(from.ll.Back())
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+	// keep the key only
+	e.value = nil
+	c.cache[e.key] = to.pushFront(e)
+	c.trimGhosts()
+}
+
+// ghosts should not remember more than the cache could hold
+func (c *ARCDict) trimGhosts() {
+	for c.b1.ll.Len() > 0 && (c.maxBytes == 0 || c.t1.bytes+c.b1.bytes > c.maxBytes) {
+		delete(c.cache, c.b1.remove(c.b1.ll.Back()).key)
+	}
+	total := func() int64 {
+		return c.t1.bytes + c.t2.bytes + c.b1.bytes + c.b2.bytes
+	}
+	for c.b2.ll.Len() > 0 && (c.maxBytes == 0 || total() > 2*c.maxBytes) {
+		delete(c.cache, c.b2.remove(c.b2.ll.Back()).key)
+	}
+}
+
+func (c *ARCDict) Remove(key string) bool {
+	ele, ok := c.cache[key]
+	if !ok {
+		return false
+	}
+	if !c.resident(ele.Value.(*entry)) {
+		// forget the ghost as well, the key is not wanted anymore
+		ele.Value.(*entry).seg.remove(ele)
+		delete(c.cache, key)
+		return false
+	}
+	c.removeElement(ele)
+	return true
+}
+
+func (c *ARCDict) RemoveOldest() {
+	if c.Len() > 0 {
+		c.evict(false)
+	}
+}
+
+func (c *ARCDict) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, s := range []*segment{c.t1, c.t2} {
+		for ele := s.ll.Back(); ele != nil; {
+			prev := ele.Prev()
+			if eviction.Expired(ele.Value.(*entry).expire, now) {
+				c.removeElement(ele)
+				removed++
+			}
+			ele = prev
+		}
+	}
+	return removed
+}
+
+// drop a resident entry without leaving a ghost behind
+func (c *ARCDict) removeElement(ele *list.Element) {
+	e := ele.Value.(*entry)
+	e.seg.remove(ele)
+	delete(c.cache, e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+func (c *ARCDict) Len() int {
+	return c.t1.ll.Len() + c.t2.ll.Len()
+}
+
+func (c *ARCDict) UsedBytes() int64 {
+	return c.t1.bytes + c.t2.bytes
+}
+
+var _ eviction.Policy = (*ARCDict)(nil)
@@ -0,0 +1,54 @@
+package arc
+
+import (
+	"fmt"
+	"testing"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestScanResistance(t *testing.T) {
+	// room for 10 entries
+	arc := New(int64(10*len("k0v")), nil)
+	for i := 0; i < 5; i++ {
+		arc.Add(fmt.Sprintf("k%d", i), String("v"))
+		// a second access moves them to t2
+		arc.Get(fmt.Sprintf("k%d", i))
+	}
+
+	// a long scan of keys seen only once
+	for i := 0; i < 100; i++ {
+		arc.Add(fmt.Sprintf("s%d", i), String("v"))
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, ok := arc.Get(fmt.Sprintf("k%d", i)); !ok {
+			t.Fatalf("frequent key k%d should survive a scan", i)
+		}
+	}
+}
+
+func TestGhostHit(t *testing.T) {
+	arc := New(int64(2*len("k0v")), nil)
+	arc.Add("k0", String("v"))
+	arc.Add("k1", String("v"))
+	// k1 moves to t2, leaving k0 alone in t1
+	arc.Get("k1")
+	arc.Add("k2", String("v"))
+
+	// k0 has been evicted to b1
+	if _, ok := arc.Get("k0"); ok {
+		t.Fatalf("k0 should be a ghost")
+	}
+	arc.Add("k0", String("v"))
+	if arc.p == 0 {
+		t.Fatalf("a hit in b1 should grow the target of t1")
+	}
+	if v, ok := arc.Get("k0"); !ok || v.(String) != "v" {
+		t.Fatalf("k0 should be resident again")
+	}
+}
@@ -0,0 +1,145 @@
+// A circuit breaker per peer.
+// When a peer keeps failing, we stop calling it for a while and load
+// locally right away instead of paying a failed network call each time.
+package qecache
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	// the peer is healthy, requests go through
+	breakerClosed breakerState = iota
+	// the peer failed too often, requests are not sent
+	breakerOpen
+	// the cooldown is over, a single probe request is let through
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Defaults of the circuit breakers
+const (
+	// consecutive failures that open the circuit
+	DEFAULT_BREAKER_THRESHOLD = 5
+	// how long the circuit stays open before a probe
+	DEFAULT_BREAKER_COOLDOWN = 10 * time.Second
+)
+
+// What a lookup gets when the circuit of the peer is open.
+// No request was sent, the caller moves on to the next peer
+var errCircuitOpen = errors.New("circuit open")
+
+type circuitBreaker struct {
+	mu    sync.Mutex
+	state breakerState
+	// failures in a row, reset by any success
+	consecutiveFailures int
+	// when the circuit was opened, or when the probe was let through
+	since time.Time
+	// totals, to tell the failure rate of the peer
+	successes int64
+	failures  int64
+	threshold int
+	cooldown  time.Duration
+	// the clock, replaceable for testing
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// Whether a request may be sent now.
+// Only call it right before sending one: after the cooldown, it hands
+// out the single probe of the half-open state
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen, breakerHalfOpen:
+		// in half-open state, a probe that never reported back must not
+		// keep the circuit stuck, so a new probe is allowed after cooldown
+		if b.now().Sub(b.since) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.since = b.now()
+		return true
+	default:
+		return true
+	}
+}
+
+// Whether allow would let a request through, without taking the probe.
+// For picking peers, when it is not known yet whether a request follows
+func (b *circuitBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed || b.now().Sub(b.since) >= b.cooldown
+}
+
+// Report the outcome of a request
+func (b *circuitBreaker) record(ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ok {
+		b.successes++
+		b.consecutiveFailures = 0
+		b.state = breakerClosed
+		return
+	}
+
+	b.failures++
+	b.consecutiveFailures++
+	// a failed probe opens the circuit again right away
+	if b.state == breakerHalfOpen || b.consecutiveFailures >= b.threshold {
+		b.state = breakerOpen
+		b.since = b.now()
+	}
+}
+
+// The health of a peer, as shown by the admin endpoint
+type PeerHealth struct {
+	Peer                string `json:"peer"`
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Successes           int64  `json:"successes"`
+	Failures            int64  `json:"failures"`
+	// Failures / (Successes + Failures)
+	FailureRate float64 `json:"failure_rate"`
+}
+
+func (b *circuitBreaker) health(peer string) PeerHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h := PeerHealth{
+		Peer:                peer,
+		State:               b.state.String(),
+		ConsecutiveFailures: b.consecutiveFailures,
+		Successes:           b.successes,
+		Failures:            b.failures,
+	}
+	if total := b.successes + b.failures; total > 0 {
+		h.FailureRate = float64(b.failures) / float64(total)
+	}
+	return h
+}
@@ -2,8 +2,29 @@
 // use byte for its universality
 package qecache
 
+import (
+	"fmt"
+	"time"
+)
+
 type ByteView struct {
 	value []byte
+	// when the value should no longer be served. Zero means never
+	expire time.Time
+	// the key does not exist, remembered by negative caching.
+	// value is empty then
+	notFound bool
+	// past expire, the value is still served until then while it is
+	// refreshed, see WithStaleWhileRevalidate. Zero means it is not
+	staleUntil time.Time
+}
+
+// Create a view of a copy of value, e.g. for a transport that received
+// it from a peer. A zero expire means it never expires
+func NewByteView(value []byte, expire time.Time) ByteView {
+	clone := make([]byte, len(value))
+	copy(clone, value)
+	return ByteView{value: clone, expire: expire}
 }
 
 func (v ByteView) Len() int {
@@ -20,3 +41,25 @@ func (v ByteView) ByteSlice() []byte {
 func (v ByteView) String() string {
 	return string(v.value)
 }
+
+// The time after which the value is stale.
+// A zero time means the value never expires.
+func (v ByteView) Expire() time.Time {
+	return v.expire
+}
+
+// When the caches should drop the value
+func (v ByteView) evictAt() time.Time {
+	if !v.staleUntil.IsZero() {
+		return v.staleUntil
+	}
+	return v.expire
+}
+
+// What a lookup returns when it finds the view in a cache
+func (v ByteView) result(key string) (ByteView, error) {
+	if v.notFound {
+		return ByteView{}, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return v, nil
+}
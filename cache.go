@@ -1,38 +1,245 @@
 // The cache structure that support concurrency
-// Encapsulated QECache/lru
+// Encapsulated an eviction.Policy, QECache/lru by default
 package qecache
 
 import (
-	"QECache/lru"
+	"QECache/eviction"
 	"sync"
+	"time"
 )
 
+// The cache is split into shards, each guarded by its own lock.
+// Goroutines working on keys of different shards no longer wait for each
+// other. Even a hit needs the exclusive lock because the policy updates its
+// bookkeeping on every read, so a single lock would serialize every hit.
 type cache struct {
+	shards []*shard
+	stats  cacheStats
+}
+
+// one partition of the cache with its own share of the bytes
+type shard struct {
 	mu       sync.Mutex
-	lru      *lru.LRUDict
+	policy   eviction.Policy
 	maxBytes int64
+	// creates policy lazily. LRU when nil
+	newPolicy eviction.Factory
+	// the stats of the whole cache, shared by its shards
+	stats *cacheStats
+	// set while an entry is removed on purpose, so that it is not
+	// counted as an eviction
+	removing bool
 }
 
-func (c *cache) add(key string, value ByteView) {
-	c.mu.Lock()
-	defer c.mu.Unlock() // defer will execute even during panic
+// Create a cache of n shards sharing maxBytes evenly, or fewer when
+// maxBytes is too small to share. A nil newPolicy means LRU
+func newCache(maxBytes int64, n int, newPolicy eviction.Factory) *cache {
+	if n < 1 {
+		n = 1
+	}
+	// a shard of 0 bytes would have no limit at all.
+	// Fewer shards are better than a cache bigger than asked
+	if maxBytes > 0 && int64(n) > maxBytes {
+		n = int(maxBytes)
+	}
+	c := &cache{shards: make([]*shard, n)}
+	for i := range c.shards {
+		c.shards[i] = &shard{maxBytes: maxBytes / int64(n), newPolicy: newPolicy, stats: &c.stats}
+	}
+	return c
+}
 
-	if c.lru == nil {
-		c.lru = lru.New(c.maxBytes, nil)
+// keys are spread by hash, so each shard sees about the same load
+func (c *cache) shardOf(key string) *shard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	// inlined FNV-1a, hash/fnv would allocate on every call
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
 	}
+	return c.shards[h%uint32(len(c.shards))]
+}
 
-	c.lru.Add(key, value)
+func (c *cache) add(key string, value ByteView) {
+	c.shardOf(key).add(key, value)
 }
 
 func (c *cache) get(key string) (value ByteView, ok bool) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.lru == nil {
+	c.stats.gets.Add(1)
+	value, ok = c.shardOf(key).get(key)
+	if ok {
+		c.stats.hits.Add(1)
+	}
+	return
+}
+
+func (c *cache) remove(key string) {
+	c.shardOf(key).remove(key)
+}
+
+// how many bytes the cache currently holds
+func (c *cache) bytes() int64 {
+	var total int64
+	for _, s := range c.shards {
+		total += s.bytes()
+	}
+	return total
+}
+
+// evict one entry from the fullest shard
+func (c *cache) removeOldest() {
+	var fullest *shard
+	var most int64
+	for _, s := range c.shards {
+		if b := s.bytes(); fullest == nil || b > most {
+			fullest, most = s, b
+		}
+	}
+	fullest.removeOldest()
+}
+
+func (c *cache) snapshot() CacheStats {
+	stats := CacheStats{
+		Gets:      c.stats.gets.Load(),
+		Hits:      c.stats.hits.Load(),
+		Evictions: c.stats.evictions.Load(),
+	}
+	for _, s := range c.shards {
+		bytes, items := s.usage()
+		stats.Bytes += bytes
+		stats.Items += items
+	}
+	return stats
+}
+
+// drop all the expired entries
+func (c *cache) removeExpired() int {
+	removed := 0
+	for _, s := range c.shards {
+		removed += s.removeExpired()
+	}
+	return removed
+}
+
+// Periodically sweep expired entries so that entries that are never read
+// again do not occupy memory until capacity pressure pushes them out.
+// It runs until stop is closed, see Controller.Close
+func (c *cache) sweepEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.removeExpired()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *shard) add(key string, value ByteView) {
+	var ttl time.Duration
+	if evictAt := value.evictAt(); !evictAt.IsZero() {
+		ttl = time.Until(evictAt)
+		if ttl <= 0 {
+			// already stale, no point to keep it.
+			// The value it replaces is outdated all the same
+			s.remove(key)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock() // defer will execute even during panic
+
+	// some policies (lru) panic on an item larger than the whole cache.
+	// Such an item simply does not fit, so we skip it, and drop the
+	// value it replaces rather than keep serving that one
+	if s.maxBytes != 0 && int64(len(key)+value.Len()) > s.maxBytes {
+		s.removeLocked(key)
+		return
+	}
+
+	if s.policy == nil {
+		if s.newPolicy == nil {
+			s.newPolicy = LRU
+		}
+		s.policy = s.newPolicy(s.maxBytes, s.onEvicted)
+	}
+
+	s.policy.AddWithTTL(key, value, ttl)
+}
+
+func (s *shard) get(key string) (value ByteView, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == nil {
 		return
 	}
 
-	if v, ok := c.lru.Get(key); ok {
+	if v, ok := s.policy.Get(key); ok {
 		return v.(ByteView), ok
 	}
 	return
 }
+
+func (s *shard) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(key)
+}
+
+// the caller must hold s.mu
+func (s *shard) removeLocked(key string) {
+	if s.policy == nil {
+		return
+	}
+	s.removing = true
+	s.policy.Remove(key)
+	s.removing = false
+}
+
+// called by the policy with the lock held
+func (s *shard) onEvicted(key string, value eviction.Value) {
+	if !s.removing {
+		s.stats.evictions.Add(1)
+	}
+}
+
+func (s *shard) usage() (bytes int64, items int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == nil {
+		return 0, 0
+	}
+	return s.policy.UsedBytes(), int64(s.policy.Len())
+}
+
+func (s *shard) bytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == nil {
+		return 0
+	}
+	return s.policy.UsedBytes()
+}
+
+func (s *shard) removeOldest() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy != nil {
+		s.policy.RemoveOldest()
+	}
+}
+
+func (s *shard) removeExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policy == nil {
+		return 0
+	}
+	return s.policy.RemoveExpired()
+}
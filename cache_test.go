@@ -0,0 +1,132 @@
+package qecache
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestShards(t *testing.T) {
+	c := newCache(1<<10, 4, nil)
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprintf("key%d", i), ByteView{value: []byte("value")})
+	}
+
+	for i, s := range c.shards {
+		if s.bytes() == 0 {
+			t.Fatalf("shard %d is empty, keys should be spread", i)
+		}
+		if s.bytes() > 1<<10/4 {
+			t.Fatalf("shard %d exceeds its share: %d", i, s.bytes())
+		}
+	}
+
+	if _, ok := c.get("key99"); !ok {
+		t.Fatalf("the most recent key should be found in its shard")
+	}
+	before := c.bytes()
+	c.removeOldest()
+	if c.bytes() >= before {
+		t.Fatalf("remove oldest should free some bytes")
+	}
+}
+
+// Every goroutine reads keys that are already cached.
+// Compare `go test -bench Parallel -cpu 32` with 1 shard and 32 shards
+func benchmarkCacheParallel(b *testing.B, shards int) {
+	const keys = 1024
+	c := newCache(0, shards, nil)
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key%d", i)
+		c.add(names[i], ByteView{value: []byte("value")})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// start at different keys so goroutines don't move in lockstep
+		i := rand.Intn(keys)
+		for pb.Next() {
+			c.get(names[i%keys])
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallel1Shard(b *testing.B)   { benchmarkCacheParallel(b, 1) }
+func BenchmarkCacheParallel32Shards(b *testing.B) { benchmarkCacheParallel(b, 32) }
+
+func TestSweepStops(t *testing.T) {
+	c := newCache(1<<10, 1, nil)
+	c.add("Tom", ByteView{value: []byte("630"), expire: time.Now().Add(time.Millisecond)})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.sweepEvery(time.Millisecond, stop)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if c.bytes() != 0 {
+		t.Fatalf("the expired entry should be swept")
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("the sweeper should stop")
+	}
+}
+
+func TestTinyShards(t *testing.T) {
+	// 3 bytes can't be shared by 8 shards
+	c := newCache(3, 8, nil)
+	if len(c.shards) != 3 {
+		t.Fatalf("expect 3 shards, got %d", len(c.shards))
+	}
+	for i := 0; i < 100; i++ {
+		c.add(fmt.Sprint(i), ByteView{})
+	}
+	if c.bytes() > 3 {
+		t.Fatalf("the cache should stay within 3 bytes, got %d", c.bytes())
+	}
+}
+
+func TestSkippedAddDropsOldValue(t *testing.T) {
+	c := newCache(64, 1, nil)
+
+	// a value too large for the shard
+	c.add("Tom", ByteView{value: []byte("630")})
+	c.add("Tom", ByteView{value: make([]byte, 100)})
+	if v, ok := c.get("Tom"); ok {
+		t.Fatalf("the old value should be gone, got %q", v.String())
+	}
+
+	// a value that already expired
+	c.add("Jack", ByteView{value: []byte("589")})
+	c.add("Jack", ByteView{value: []byte("590"), expire: time.Now().Add(-time.Second)})
+	if v, ok := c.get("Jack"); ok {
+		t.Fatalf("the old value should be gone, got %q", v.String())
+	}
+	if stats := c.snapshot(); stats.Evictions != 0 {
+		t.Fatalf("dropping a replaced value is not an eviction, got %d", stats.Evictions)
+	}
+
+	// the same through a write of the controller
+	gee := NewController("skipped-add", 64, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte("db " + key), nil
+	}))
+	t.Cleanup(gee.Close)
+	gee.Set("Sam", []byte("567"))
+	if v, _ := gee.Get("Sam"); v.String() != "567" {
+		t.Fatalf("the first write should be served, got %q", v.String())
+	}
+	if err := gee.Set("Sam", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := gee.Get("Sam"); v.String() != "db Sam" {
+		t.Fatalf("the value written before should not be served, got %q", v.String())
+	}
+}
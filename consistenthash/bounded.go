@@ -0,0 +1,122 @@
+package consistenthash
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// How much more than the average load a node may take
+const DEFAULT_LOAD_FACTOR = 0.25
+
+// Consistent hashing with bounded loads, "Consistent Hashing with
+// Bounded Loads", Mirrokni, Thorup and Zadimoghaddam, 2016.
+// It is the ring, except that a node already handling more than
+// (1 + loadFactor) times its share of the requests in flight passes the
+// key to the next node on the ring. A hot key can't overload its owner.
+//
+// Loads are only known locally, so while a node is loaded the nodes of
+// the cluster may disagree on who owns its keys.
+// Count the keys the node loads itself as well, under its own name:
+// otherwise it always looks idle and keeps every key it owns.
+// It is safe for concurrent use, as Inc and Done are called outside of
+// the lock of the caller.
+type Bounded struct {
+	mu         sync.Mutex
+	ring       *KeyHashInfo
+	loadFactor float64
+	loads      map[string]int
+	total      int
+}
+
+// Parameters:
+// - vnodeScalar, fn: the same as New
+// - loadFactor: DEFAULT_LOAD_FACTOR when 0
+func NewBounded(vnodeScalar int, loadFactor float64, fn Hash) *Bounded {
+	if loadFactor == 0 {
+		loadFactor = DEFAULT_LOAD_FACTOR
+	}
+	return &Bounded{
+		ring:       New(vnodeScalar, fn),
+		loadFactor: loadFactor,
+		loads:      make(map[string]int),
+	}
+}
+
+func (b *Bounded) Add(nodes ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ring.Add(nodes...)
+}
+
+func (b *Bounded) AddWeighted(node string, weight int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ring.AddWeighted(node, weight)
+}
+
+func (b *Bounded) Remove(nodes ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ring.Remove(nodes...)
+}
+
+// The first node from the owner on, clockwise, that can take one more
+// request. It does not count the request, call Inc when sending it
+func (b *Bounded) Get(key string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := b.ring
+	if len(m.keys) == 0 {
+		return ""
+	}
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+
+	// vnodes of the same node are checked again, that's harmless.
+	// Somebody is always under the bound, so the loop ends
+	for i := 0; i < len(m.keys); i++ {
+		node := m.vnodeDict[m.keys[(idx+i)%len(m.keys)]]
+		if b.loads[node]+1 <= b.capacity(node) {
+			return node
+		}
+	}
+	return m.vnodeDict[m.keys[idx%len(m.keys)]]
+}
+
+// the share of the requests in flight, plus the one to place,
+// that a node may take
+func (b *Bounded) capacity(node string) int {
+	totalWeight := 0
+	for _, weight := range b.ring.weights {
+		totalWeight += weight
+	}
+	share := float64(b.total+1) * float64(b.ring.weights[node]) / float64(totalWeight)
+	return int(math.Ceil(share * (1 + b.loadFactor)))
+}
+
+func (b *Bounded) Inc(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.loads[node]++
+	b.total++
+}
+
+func (b *Bounded) Done(node string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.loads[node] == 0 {
+		return
+	}
+	b.loads[node]--
+	if b.loads[node] == 0 {
+		delete(b.loads, node)
+	}
+	b.total--
+}
+
+var _ WeightedPlacement = (*Bounded)(nil)
+var _ LoadTracker = (*Bounded)(nil)
@@ -2,6 +2,7 @@ package consistenthash
 
 import (
 	"hash/crc32"
+	"slices"
 	"sort"
 	"strconv"
 )
@@ -19,6 +20,8 @@ type KeyHashInfo struct {
 	keys []int
 	// records of vnode to physical node
 	vnodeDict map[int]string
+	// the weight of each physical node, it has vnodeScalar*weight vnodes
+	weights map[string]int
 }
 
 func New(vnodeScalar int, fn Hash) *KeyHashInfo {
@@ -26,6 +29,7 @@ func New(vnodeScalar int, fn Hash) *KeyHashInfo {
 		vnodeScalar: vnodeScalar,
 		hash:        fn,
 		vnodeDict:   make(map[int]string),
+		weights:     make(map[string]int),
 	}
 	if m.hash == nil {
 		m.hash = crc32.ChecksumIEEE
@@ -33,17 +37,75 @@ func New(vnodeScalar int, fn Hash) *KeyHashInfo {
 	return m
 }
 
+// Add nodes of weight 1. Nodes that are already there keep their weight
 func (m *KeyHashInfo) Add(keys ...string) {
 	for _, key := range keys {
-		for i := 0; i < m.vnodeScalar; i++ {
-			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
-			m.keys = append(m.keys, hash)
-			m.vnodeDict[hash] = key
+		if _, ok := m.weights[key]; ok {
+			continue
 		}
+		m.addVnodes(key, 1)
+	}
+	sort.Ints(m.keys)
+}
+
+// Add a node that takes about weight times as many keys as a node of
+// weight 1, e.g. the memory of the machine in GB.
+// Adding a node again changes its weight, only the keys of the vnodes
+// added or removed move
+func (m *KeyHashInfo) AddWeighted(key string, weight int) {
+	if weight < 1 {
+		weight = 1
 	}
+	m.Remove(key)
+	m.addVnodes(key, weight)
 	sort.Ints(m.keys)
 }
 
+// the caller sorts m.keys afterwards
+func (m *KeyHashInfo) addVnodes(key string, weight int) {
+	// vnodes 0 to vnodeScalar-1 are the same whatever the weight,
+	// so that a heavier node takes keys without giving any back
+	for i := 0; i < m.vnodeScalar*weight; i++ {
+		hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+		m.keys = append(m.keys, hash)
+		m.vnodeDict[hash] = key
+	}
+	m.weights[key] = weight
+}
+
+// Remove nodes and their vnodes, in place.
+// Only the keys of the removed nodes move, to the next vnodes on the ring
+func (m *KeyHashInfo) Remove(keys ...string) {
+	removed := false
+	for _, key := range keys {
+		weight, ok := m.weights[key]
+		if !ok {
+			continue
+		}
+		delete(m.weights, key)
+		for i := 0; i < m.vnodeScalar*weight; i++ {
+			hash := int(m.hash([]byte(strconv.Itoa(i) + key)))
+			// on a collision, the vnode may belong to another node
+			if m.vnodeDict[hash] == key {
+				delete(m.vnodeDict, hash)
+				removed = true
+			}
+		}
+	}
+	if !removed {
+		return
+	}
+
+	// filter in place, the order is kept so no need to sort again
+	kept := m.keys[:0]
+	for _, hash := range m.keys {
+		if _, ok := m.vnodeDict[hash]; ok {
+			kept = append(kept, hash)
+		}
+	}
+	m.keys = kept
+}
+
 func (m *KeyHashInfo) Get(key string) string {
 	if len(m.keys) == 0 {
 		return ""
@@ -57,3 +119,26 @@ func (m *KeyHashInfo) Get(key string) string {
 
 	return m.vnodeDict[m.keys[idx%len(m.keys)]]
 }
+
+// The first n distinct nodes clockwise from the key, the owner first.
+// They are the replicas of the key. Fewer when there are fewer nodes
+func (m *KeyHashInfo) GetN(key string, n int) []string {
+	if len(m.keys) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(m.weights))
+
+	hash := int(m.hash([]byte(key)))
+	idx := sort.Search(len(m.keys), func(i int) bool {
+		return m.keys[i] >= hash
+	})
+
+	nodes := make([]string, 0, n)
+	for i := 0; i < len(m.keys) && len(nodes) < n; i++ {
+		node := m.vnodeDict[m.keys[(idx+i)%len(m.keys)]]
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
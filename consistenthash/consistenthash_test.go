@@ -1,6 +1,8 @@
 package consistenthash
 
 import (
+	"hash/fnv"
+	"slices"
 	"strconv"
 	"testing"
 )
@@ -41,3 +43,123 @@ func TestHashing(t *testing.T) {
 	}
 
 }
+
+func TestRemove(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// 2, 4, 6, 8, 12, 14, 16, 18, 22, 24, 26, 28
+	hash.Add("6", "4", "2", "8")
+	hash.Remove("4")
+
+	// keys of 4 move to the next node, the others stay
+	testCases := map[string]string{
+		"2":  "2",
+		"3":  "6",
+		"13": "6",
+		"27": "8",
+	}
+	for k, v := range testCases {
+		if hash.Get(k) != v {
+			t.Errorf("Asking for %s, should have yielded %s, got %s", k, v, hash.Get(k))
+		}
+	}
+	if len(hash.keys) != 9 || len(hash.vnodeDict) != 9 {
+		t.Errorf("vnodes of 4 should be gone, got %v", hash.keys)
+	}
+
+	hash.Remove("6", "2", "8")
+	if hash.Get("2") != "" {
+		t.Errorf("an empty ring should yield nothing")
+	}
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	weights := map[string]int{
+		"http://small:8001":  1,
+		"http://medium:8002": 2,
+		"http://large:8003":  8,
+	}
+	// CRC32 places vnodes with similar names close to each other,
+	// which blurs the effect of the weights. FNV spreads them better
+	hash := New(100, func(data []byte) uint32 {
+		h := fnv.New32a()
+		h.Write(data)
+		return h.Sum32()
+	})
+	total := 0
+	for node, weight := range weights {
+		hash.AddWeighted(node, weight)
+		total += weight
+	}
+
+	const keys = 100000
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		counts[hash.Get("key"+strconv.Itoa(i))]++
+	}
+
+	// each node gets its share of the keys, give or take 25%
+	for node, weight := range weights {
+		want := float64(keys) * float64(weight) / float64(total)
+		got := float64(counts[node])
+		if got < 0.75*want || got > 1.25*want {
+			t.Errorf("%s of weight %d got %.0f keys, want about %.0f", node, weight, got, want)
+		}
+	}
+}
+
+func TestReweight(t *testing.T) {
+	hash := New(10, nil)
+	hash.Add("a", "b", "c")
+
+	owners := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		owners[key] = hash.Get(key)
+	}
+
+	// a heavier node only takes keys
+	hash.AddWeighted("a", 3)
+	for key, owner := range owners {
+		if now := hash.Get(key); now != owner && now != "a" {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+	}
+
+	// back to weight 1, everything is back in place
+	hash.AddWeighted("a", 1)
+	for key, owner := range owners {
+		if now := hash.Get(key); now != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+	}
+}
+
+func TestGetN(t *testing.T) {
+	hash := New(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+
+	// 2, 4, 6, 12, 14, 16, 22, 24, 26
+	hash.Add("6", "4", "2")
+
+	testCases := map[string][]string{
+		"3":  {"4", "6"},
+		"15": {"6", "2"},
+		"27": {"2", "4"},
+	}
+	for k, v := range testCases {
+		if got := hash.GetN(k, 2); !slices.Equal(got, v) {
+			t.Errorf("Asking for %s, should have yielded %v, got %v", k, v, got)
+		}
+	}
+
+	// never more than the nodes
+	if got := hash.GetN("3", 5); !slices.Equal(got, []string{"4", "6", "2"}) {
+		t.Errorf("should have yielded every node, got %v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package consistenthash
+
+// Jump consistent hash, "A Fast, Minimal Memory, Consistent Hash
+// Algorithm", Lamping and Veach, 2014.
+// Keys go to numbered buckets with no memory and a near perfect balance.
+// Adding a bucket at the end only takes keys, but buckets can't be taken
+// out of the middle: removing a node moves the last bucket into its
+// place, so the keys of both nodes move.
+//
+// caveat: the buckets follow the order of the changes, they are not
+// sorted since that would move most keys on every change. Every node must
+// add and remove the same nodes in the same order, e.g. SetPeers with the
+// same list everywhere, or two nodes disagree on the owner of a key.
+// Membership gossip reaches each node in its own order: use Rendezvous or
+// Maglev there, they only depend on the set of nodes
+type Jump struct {
+	hash Hash
+	// the bucket number is the index, a node of weight w has w buckets
+	buckets []string
+	weights map[string]int
+}
+
+func NewJump(fn Hash) *Jump {
+	j := &Jump{
+		hash:    fn,
+		weights: make(map[string]int),
+	}
+	if j.hash == nil {
+		j.hash = mixHash
+	}
+	return j
+}
+
+// Nodes get the next buckets, in the order given
+func (j *Jump) Add(nodes ...string) {
+	for _, node := range nodes {
+		if _, ok := j.weights[node]; !ok {
+			j.AddWeighted(node, 1)
+		}
+	}
+}
+
+func (j *Jump) AddWeighted(node string, weight int) {
+	weight = max(weight, 1)
+	current := j.weights[node]
+	for ; current < weight; current++ {
+		j.buckets = append(j.buckets, node)
+	}
+	for ; current > weight; current-- {
+		j.removeBucket(node)
+	}
+	j.weights[node] = weight
+}
+
+func (j *Jump) Remove(nodes ...string) {
+	for _, node := range nodes {
+		for i := j.weights[node]; i > 0; i-- {
+			j.removeBucket(node)
+		}
+		delete(j.weights, node)
+	}
+}
+
+// move the last bucket in place of the last bucket of the node
+func (j *Jump) removeBucket(node string) {
+	for i := len(j.buckets) - 1; i >= 0; i-- {
+		if j.buckets[i] == node {
+			last := len(j.buckets) - 1
+			j.buckets[i] = j.buckets[last]
+			j.buckets = j.buckets[:last]
+			return
+		}
+	}
+}
+
+func (j *Jump) Get(key string) string {
+	if len(j.buckets) == 0 {
+		return ""
+	}
+	return j.buckets[jumpHash(uint64(j.hash([]byte(key))), len(j.buckets))]
+}
+
+// Straight from the paper. A key jumps forward to bucket b with
+// probability 1/b, so a new bucket takes 1/n of the keys of each other one
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+var _ WeightedPlacement = (*Jump)(nil)
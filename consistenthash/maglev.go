@@ -0,0 +1,143 @@
+package consistenthash
+
+import "sort"
+
+// The size of the lookup table. It must be a prime, much larger than
+// the number of nodes: the imbalance is about nodes / size
+const DEFAULT_MAGLEV_TABLE_SIZE = 65537
+
+// Maglev hashing, "Maglev: A Fast and Reliable Software Network Load
+// Balancer", Eisenbud et al., 2016.
+// Nodes take turns to claim slots of a lookup table, each one in its own
+// pseudo random order. Lookups are a single index and the balance is
+// near perfect, while a change of nodes moves slightly more keys than
+// the minimum. The table is rebuilt on every change
+type Maglev struct {
+	hash    Hash
+	size    int
+	weights map[string]int
+	// slot to node
+	table []string
+}
+
+// Parameters:
+// - size: a prime, DEFAULT_MAGLEV_TABLE_SIZE when 0. Other sizes are
+// rounded up to the next prime: with a size that is not a prime, the
+// preference list of a node may skip slots and never fill the table
+func NewMaglev(size int, fn Hash) *Maglev {
+	m := &Maglev{
+		hash:    fn,
+		size:    size,
+		weights: make(map[string]int),
+	}
+	if m.hash == nil {
+		m.hash = mixHash
+	}
+	if m.size <= 0 {
+		m.size = DEFAULT_MAGLEV_TABLE_SIZE
+	}
+	m.size = nextPrime(m.size)
+	return m
+}
+
+// the smallest prime >= n. Trial division is plenty for table sizes
+func nextPrime(n int) int {
+	for ; ; n++ {
+		if isPrime(n) {
+			return n
+		}
+	}
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for d := 2; d*d <= n; d++ {
+		if n%d == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Maglev) Add(nodes ...string) {
+	added := false
+	for _, node := range nodes {
+		if _, ok := m.weights[node]; !ok {
+			m.weights[node] = 1
+			added = true
+		}
+	}
+	if added {
+		m.populate()
+	}
+}
+
+func (m *Maglev) AddWeighted(node string, weight int) {
+	m.weights[node] = max(weight, 1)
+	m.populate()
+}
+
+func (m *Maglev) Remove(nodes ...string) {
+	for _, node := range nodes {
+		delete(m.weights, node)
+	}
+	m.populate()
+}
+
+func (m *Maglev) Get(key string) string {
+	if len(m.table) == 0 {
+		return ""
+	}
+	return m.table[int(m.hash([]byte(key)))%m.size]
+}
+
+// Fill the table, as in section 3.4 of the paper.
+// A node of weight w claims w slots per turn
+func (m *Maglev) populate() {
+	if len(m.weights) == 0 {
+		m.table = nil
+		return
+	}
+
+	// the order of turns must be the same on every node
+	nodes := make([]string, 0, len(m.weights))
+	for node := range m.weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	// the preference list of node i is offset + j*skip, j = 0, 1, ...
+	// Since size is a prime, it visits every slot
+	offsets := make([]int, len(nodes))
+	skips := make([]int, len(nodes))
+	for i, node := range nodes {
+		offsets[i] = int(m.hash([]byte("offset"+node))) % m.size
+		skips[i] = int(m.hash([]byte("skip"+node)))%(m.size-1) + 1
+	}
+
+	next := make([]int, len(nodes))
+	table := make([]string, m.size)
+	filled := 0
+	for {
+		for i, node := range nodes {
+			for w := 0; w < m.weights[node]; w++ {
+				slot := (offsets[i] + next[i]*skips[i]) % m.size
+				for table[slot] != "" {
+					next[i]++
+					slot = (offsets[i] + next[i]*skips[i]) % m.size
+				}
+				table[slot] = node
+				next[i]++
+				filled++
+				if filled == m.size {
+					m.table = table
+					return
+				}
+			}
+		}
+	}
+}
+
+var _ WeightedPlacement = (*Maglev)(nil)
@@ -0,0 +1,58 @@
+package consistenthash
+
+import "hash/fnv"
+
+// Decides which node owns a key.
+// Implementations are not safe for concurrent use unless told otherwise,
+// the caller guards them with its own lock
+type Placement interface {
+	// Add nodes of weight 1. Nodes that are already there are left alone
+	Add(nodes ...string)
+	Remove(nodes ...string)
+	// the node owning the key, "" when there is no node
+	Get(key string) string
+}
+
+// A Placement that can give some nodes more keys than others
+type WeightedPlacement interface {
+	Placement
+	// Add a node that takes about weight times as many keys as a node of
+	// weight 1. Adding a node again changes its weight
+	AddWeighted(node string, weight int)
+}
+
+// A Placement that gives each key several owners, the replicas
+type ReplicatedPlacement interface {
+	Placement
+	// the first n owners of the key, Get(key) first, all distinct.
+	// Fewer when there are fewer nodes
+	GetN(key string, n int) []string
+}
+
+// A Placement that takes the load of nodes into account.
+// The caller tells when a request to a node starts and ends
+type LoadTracker interface {
+	Inc(node string)
+	Done(node string)
+}
+
+var _ WeightedPlacement = (*KeyHashInfo)(nil)
+var _ ReplicatedPlacement = (*KeyHashInfo)(nil)
+
+// FNV-1a followed by the finalizer of MurmurHash3.
+// Unlike CRC32, a one byte change flips about half of the bits, which
+// matters when node names only differ by a digit
+func mixHash(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return fmix32(h.Sum32())
+}
+
+func fmix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,213 @@
+package consistenthash
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+var placements = []struct {
+	name string
+	new  func() WeightedPlacement
+}{
+	{"ring", func() WeightedPlacement { return New(4, nil) }},
+	{"ring-160", func() WeightedPlacement { return New(160, mixHash) }},
+	{"rendezvous", func() WeightedPlacement { return NewRendezvous(nil) }},
+	{"jump", func() WeightedPlacement { return NewJump(nil) }},
+	{"maglev", func() WeightedPlacement { return NewMaglev(0, nil) }},
+	{"bounded", func() WeightedPlacement { return NewBounded(160, 0, mixHash) }},
+}
+
+func nodeNames(n int) []string {
+	nodes := make([]string, n)
+	for i := range nodes {
+		nodes[i] = fmt.Sprintf("http://10.0.0.%d:8001", i)
+	}
+	return nodes
+}
+
+func owners(p Placement, keys int) []string {
+	owners := make([]string, keys)
+	for i := range owners {
+		owners[i] = p.Get("key" + strconv.Itoa(i))
+	}
+	return owners
+}
+
+// the largest share of keys of a node, relative to the fair share
+func imbalance(owners []string, nodes int) float64 {
+	counts := make(map[string]int)
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	most := 0
+	for _, count := range counts {
+		most = max(most, count)
+	}
+	return float64(most) * float64(nodes) / float64(len(owners))
+}
+
+// the fraction of keys whose owner changed
+func remapped(before []string, after []string) float64 {
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+		}
+	}
+	return float64(moved) / float64(len(before))
+}
+
+func TestPlacement(t *testing.T) {
+	const keys = 20000
+	for _, tt := range placements {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.new()
+			if owner := p.Get("Tom"); owner != "" {
+				t.Fatalf("an empty placement should yield nothing, got %s", owner)
+			}
+
+			nodes := nodeNames(10)
+			p.Add(nodes...)
+			p.Add(nodes[0]) // no-op
+			before := owners(p, keys)
+			for i, owner := range before {
+				if owner == "" {
+					t.Fatalf("key%d has no owner", i)
+				}
+			}
+
+			// only the removed node loses keys. Jump also moves the last node
+			p.Remove(nodes[3])
+			after := owners(p, keys)
+			for i := range before {
+				if after[i] == nodes[3] {
+					t.Fatalf("key%d is still owned by the removed node", i)
+				}
+				if before[i] != nodes[3] && before[i] != after[i] && tt.name != "jump" && tt.name != "maglev" {
+					t.Fatalf("key%d moved from %s to %s", i, before[i], after[i])
+				}
+			}
+			// about a tenth of the keys should move, give some slack
+			if r := remapped(before, after); r > 0.25 {
+				t.Fatalf("%.0f%% of the keys moved", r*100)
+			}
+
+			// adding it back restores the placement, except for jump
+			// whose buckets were reordered
+			p.Add(nodes[3])
+			if r := remapped(before, owners(p, keys)); r > 0.01 && tt.name != "jump" {
+				t.Fatalf("%.1f%% of the keys did not come back", r*100)
+			}
+		})
+	}
+}
+
+func TestPlacementWeights(t *testing.T) {
+	const keys = 50000
+	for _, tt := range placements {
+		if tt.name == "ring" {
+			// too few vnodes to tell
+			continue
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.new()
+			p.Add("a", "b")
+			p.AddWeighted("c", 4)
+
+			counts := make(map[string]int)
+			for _, owner := range owners(p, keys) {
+				counts[owner]++
+			}
+			// c should get 4/6 of the keys
+			if share := float64(counts["c"]) / keys; math.Abs(share-4./6) > 0.1 {
+				t.Fatalf("c got %.2f of the keys, want about 0.67", share)
+			}
+		})
+	}
+}
+
+func TestBoundedLoad(t *testing.T) {
+	b := NewBounded(160, 0.25, mixHash)
+	b.Add(nodeNames(4)...)
+
+	owner := b.Get("hot")
+	// the owner is busy with the hot key
+	for i := 0; i < 10; i++ {
+		b.Inc(b.Get("hot"))
+	}
+	if b.loads[owner] > 4 {
+		t.Fatalf("the owner took %d requests, more than its bound", b.loads[owner])
+	}
+	if other := b.Get("hot"); other == owner {
+		t.Fatalf("the loaded owner should pass the key on")
+	}
+
+	for node, load := range b.loads {
+		for ; load > 0; load-- {
+			b.Done(node)
+		}
+	}
+	if b.Get("hot") != owner || b.total != 0 {
+		t.Fatalf("the owner should take the key back once idle")
+	}
+}
+
+// Report how evenly keys are spread over 10 nodes, and how many move
+// when an 11th node joins, in addition to the speed of lookups.
+// go test -bench Placement ./consistenthash
+func BenchmarkPlacement(b *testing.B) {
+	const keys = 100000
+	for _, tt := range placements {
+		b.Run(tt.name, func(b *testing.B) {
+			p := tt.new()
+			nodes := nodeNames(11)
+			p.Add(nodes[:10]...)
+			before := owners(p, keys)
+			p.Add(nodes[10])
+			after := owners(p, keys)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				p.Get("key" + strconv.Itoa(i%keys))
+			}
+			b.ReportMetric(imbalance(before, 10), "max/avg")
+			// 1/11 = 9.1% at best
+			b.ReportMetric(remapped(before, after)*100, "remap%")
+		})
+	}
+}
+
+func TestReplicatedPlacement(t *testing.T) {
+	for _, p := range []ReplicatedPlacement{New(160, mixHash), NewRendezvous(nil)} {
+		p.Add(nodeNames(5)...)
+		for i := 0; i < 1000; i++ {
+			key := "key" + strconv.Itoa(i)
+			replicas := p.GetN(key, 3)
+			if len(replicas) != 3 || replicas[0] != p.Get(key) {
+				t.Fatalf("%T: the owner should come first, got %v", p, replicas)
+			}
+			if replicas[1] == replicas[0] || replicas[2] == replicas[1] || replicas[2] == replicas[0] {
+				t.Fatalf("%T: replicas should be distinct, got %v", p, replicas)
+			}
+		}
+	}
+}
+
+func TestMaglevTableSize(t *testing.T) {
+	if m := NewMaglev(DEFAULT_MAGLEV_TABLE_SIZE, nil); m.size != DEFAULT_MAGLEV_TABLE_SIZE {
+		t.Fatalf("a prime size should stay, got %d", m.size)
+	}
+	// 100 = 4 * 25, a node whose skip is 50 would only visit 2 slots
+	m := NewMaglev(100, nil)
+	if m.size != 101 {
+		t.Fatalf("want the next prime 101, got %d", m.size)
+	}
+	m.Add(nodeNames(10)...)
+	for i, owner := range owners(m, 1000) {
+		if owner == "" {
+			t.Fatalf("key%d has no owner", i)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package consistenthash
+
+import (
+	"math"
+	"sort"
+)
+
+// Rendezvous, or highest random weight (HRW), hashing.
+// Every node scores the key, the highest score owns it. Removing a node
+// only moves its own keys and adding one only takes keys, with a perfect
+// balance and no vnodes. The price is a lookup in O(nodes)
+type Rendezvous struct {
+	hash    Hash
+	weights map[string]int
+	// iterate over a slice rather than the map, it is faster
+	nodes []string
+}
+
+func NewRendezvous(fn Hash) *Rendezvous {
+	r := &Rendezvous{
+		hash:    fn,
+		weights: make(map[string]int),
+	}
+	if r.hash == nil {
+		r.hash = mixHash
+	}
+	return r
+}
+
+func (r *Rendezvous) Add(nodes ...string) {
+	for _, node := range nodes {
+		if _, ok := r.weights[node]; !ok {
+			r.AddWeighted(node, 1)
+		}
+	}
+}
+
+func (r *Rendezvous) AddWeighted(node string, weight int) {
+	if _, ok := r.weights[node]; !ok {
+		r.nodes = append(r.nodes, node)
+	}
+	r.weights[node] = max(weight, 1)
+}
+
+func (r *Rendezvous) Remove(nodes ...string) {
+	for _, node := range nodes {
+		delete(r.weights, node)
+	}
+	kept := r.nodes[:0]
+	for _, node := range r.nodes {
+		if _, ok := r.weights[node]; ok {
+			kept = append(kept, node)
+		}
+	}
+	r.nodes = kept
+}
+
+func (r *Rendezvous) Get(key string) string {
+	owner := ""
+	best := math.Inf(-1)
+	buf := make([]byte, 0, 64)
+	for _, node := range r.nodes {
+		buf = append(append(buf[:0], node...), key...)
+		score := r.score(r.hash(buf), r.weights[node])
+		// break ties by name so that every node agrees
+		if score > best || (score == best && node < owner) {
+			owner, best = node, score
+		}
+	}
+	return owner
+}
+
+// The n nodes of highest score. Removing one of them promotes the
+// next ones, so the replicas of a key change as little as possible
+func (r *Rendezvous) GetN(key string, n int) []string {
+	type scored struct {
+		node  string
+		score float64
+	}
+	all := make([]scored, 0, len(r.nodes))
+	buf := make([]byte, 0, 64)
+	for _, node := range r.nodes {
+		buf = append(append(buf[:0], node...), key...)
+		all = append(all, scored{node, r.score(r.hash(buf), r.weights[node])})
+	}
+	// the same order as Get, ties broken by name
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].node < all[j].node
+	})
+
+	nodes := make([]string, 0, min(n, len(all)))
+	for _, s := range all[:min(max(n, 0), len(all))] {
+		nodes = append(nodes, s.node)
+	}
+	return nodes
+}
+
+// The weighted score of "Weighted Distributed Hash Tables", Schindelhauer
+// and Schomaker, 2005: -weight / ln(h) with h uniform in (0, 1).
+// A node of weight w wins about w times as often as a node of weight 1
+func (r *Rendezvous) score(h uint32, weight int) float64 {
+	// +0.5 keeps h away from both 0 and 1
+	u := (float64(h) + 0.5) / (1 << 32)
+	return -float64(weight) / math.Log(u)
+}
+
+var _ WeightedPlacement = (*Rendezvous)(nil)
+var _ ReplicatedPlacement = (*Rendezvous)(nil)
@@ -2,10 +2,14 @@
 package qecache
 
 import (
+	"QECache/eviction"
 	"QECache/singleflight"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"sync"
+	"time"
 )
 
 // the data fetcher. Invoked when cache miss
@@ -24,6 +28,98 @@ func (f FetcherFunc) Fetch(key string) ([]byte, error) {
 	return f(key)
 }
 
+// A fetcher that also decides how long the fetched value stays fresh.
+// Controller checks whether its fetcher implements this interface,
+// so a plain Fetcher keeps working as before.
+// A ttl of 0 falls back to the controller default (see WithTTL),
+// a negative ttl means the value never expires.
+type TTLFetcher interface {
+	FetchWithTTL(key string) ([]byte, time.Duration, error)
+}
+
+// Same trick as FetcherFunc.
+// It implements both Fetcher and TTLFetcher so it can be handed
+// to NewController directly
+type TTLFetcherFunc func(key string) ([]byte, time.Duration, error)
+
+func (f TTLFetcherFunc) Fetch(key string) ([]byte, error) {
+	bytes, _, err := f(key)
+	return bytes, err
+}
+
+func (f TTLFetcherFunc) FetchWithTTL(key string) ([]byte, time.Duration, error) {
+	return f(key)
+}
+
+// A fetcher that can be cancelled.
+// The context comes from the caller of Controller.GetContext,
+// or from the HTTP request of a peer. Give up when it is done.
+// The ttl follows the same rules as TTLFetcher.
+type FetcherContext interface {
+	FetchContext(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
+// Same trick as FetcherFunc.
+// It implements Fetcher, TTLFetcher and FetcherContext
+type FetcherContextFunc func(ctx context.Context, key string) ([]byte, time.Duration, error)
+
+func (f FetcherContextFunc) Fetch(key string) ([]byte, error) {
+	bytes, _, err := f(context.Background(), key)
+	return bytes, err
+}
+
+func (f FetcherContextFunc) FetchWithTTL(key string) ([]byte, time.Duration, error) {
+	return f(context.Background(), key)
+}
+
+func (f FetcherContextFunc) FetchContext(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	return f(ctx, key)
+}
+
+// A fetcher that loads many keys at once, e.g. with a single query.
+// GetMulti hands it the keys the current node loads itself, while the
+// other lookups still go through Fetch.
+// The keys missing from values do not exist. The ttl follows the same
+// rules as TTLFetcher and applies to every value. An error fails them all
+type BatchFetcher interface {
+	FetchMulti(ctx context.Context, keys []string) (values map[string][]byte, ttl time.Duration, err error)
+}
+
+// Same trick as FetcherFunc.
+// It implements Fetcher, TTLFetcher, FetcherContext and BatchFetcher:
+// a single key is fetched as a batch of one
+type BatchFetcherFunc func(ctx context.Context, keys []string) (map[string][]byte, time.Duration, error)
+
+func (f BatchFetcherFunc) Fetch(key string) ([]byte, error) {
+	bytes, _, err := f.FetchContext(context.Background(), key)
+	return bytes, err
+}
+
+func (f BatchFetcherFunc) FetchWithTTL(key string) ([]byte, time.Duration, error) {
+	return f.FetchContext(context.Background(), key)
+}
+
+func (f BatchFetcherFunc) FetchContext(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	values, ttl, err := f(ctx, []string{key})
+	if err != nil {
+		return nil, 0, err
+	}
+	bytes, ok := values[key]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: %w", key, ErrNotFound)
+	}
+	return bytes, ttl, nil
+}
+
+func (f BatchFetcherFunc) FetchMulti(ctx context.Context, keys []string) (map[string][]byte, time.Duration, error) {
+	return f(ctx, keys)
+}
+
+// Fetchers wrap this error, e.g. fmt.Errorf("%s: %w", key, ErrNotFound),
+// to tell that the key does not exist rather than that the fetch failed.
+// Test it with errors.Is. See WithNegativeTTL
+var ErrNotFound = errors.New("not found")
+
 type Controller struct {
 	// The name of the controller
 	// Allow create multiple controllers.
@@ -32,11 +128,142 @@ type Controller struct {
 	// The data fetcher which is invoked when miss
 	fetcher Fetcher
 	// the underlying cache structure
-	mainCache cache
+	// it holds the keys this node owns
+	mainCache *cache
+	// a smaller cache for keys owned by other nodes.
+	// It keeps popular keys on this node so that we don't pay an HTTP
+	// round trip each time they are requested
+	hotCache *cache
+	// mainCache and hotCache together never exceed it. 0 means no limit
+	maxBytes int64
+	// one in hotSampling values fetched from peers goes into hotCache.
+	// 0 disables the hot cache
+	hotSampling int
 	// allow loading from peers
 	peers PeerDict
 	// single flight loader
 	sfloader *singleflight.Group
+	// how long a locally fetched value lives if the fetcher does not say.
+	// 0 means forever
+	ttl time.Duration
+	// how long a key that does not exist is remembered. 0 disables it
+	negativeTTL time.Duration
+	// how long an expired value is still served while it is refreshed.
+	// 0 disables it
+	staleWindow time.Duration
+	// how long before it expires a value read is refreshed. 0 disables it
+	refreshAhead time.Duration
+	// how often expired entries are swept. 0 disables the sweeper
+	sweepInterval time.Duration
+	// closed by Close to stop the sweepers
+	stop      chan struct{}
+	closeOnce sync.Once
+	// the eviction policy of both caches. LRU when nil
+	policy eviction.Factory
+	// how many shards each cache is split into
+	shards int
+	// caps the calls to the fetcher, see WithMaxConcurrentFetches
+	limiter fetchLimiter
+	// counters, see Stats
+	stats controllerStats
+	// where to write logs
+	logger Logger
+}
+
+// How often the background sweeper drops expired entries by default
+const DEFAULT_SWEEP_INTERVAL = time.Minute
+
+// By default one in ten values fetched from peers is kept in hotCache
+const DEFAULT_HOT_CACHE_SAMPLING = 10
+
+// hotCache may take at most 1/HOT_CACHE_RATIO of maxBytes
+const HOT_CACHE_RATIO = 8
+
+// Optional settings of a controller.
+// We use the functional option pattern so that NewController
+// stays compatible with existing callers
+type ControllerOption func(*Controller)
+
+// Set a default time-to-live for values loaded by the fetcher.
+// A TTLFetcher can still override it per key.
+func WithTTL(ttl time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.ttl = ttl
+	}
+}
+
+// Keep one in every `sampling` values fetched from peers in the hot cache.
+// Pass 0 to disable the hot cache.
+func WithHotCacheSampling(sampling int) ControllerOption {
+	return func(c *Controller) {
+		c.hotSampling = sampling
+	}
+}
+
+// Choose how entries are evicted when the cache is full, e.g. WithEvictionPolicy(ARC).
+// Both mainCache and hotCache use the same policy. LRU by default.
+func WithEvictionPolicy(policy eviction.Factory) ControllerOption {
+	return func(c *Controller) {
+		c.policy = policy
+	}
+}
+
+// Split each cache into n shards, each with its own lock and 1/n of the bytes.
+// More shards mean less contention between goroutines, but the eviction
+// becomes less accurate since each shard only sees its own entries.
+// A shard never holds an entry larger than its share of bytes.
+// 1 by default.
+func WithShards(n int) ControllerOption {
+	return func(c *Controller) {
+		c.shards = n
+	}
+}
+
+// Write logs to the given logger instead of slog.Default().
+// Every record carries the name of the controller.
+func WithLogger(logger Logger) ControllerOption {
+	return func(c *Controller) {
+		c.logger = logger
+	}
+}
+
+// Remember for ttl that a key does not exist, when the fetcher returns
+// an error wrapping ErrNotFound. Lookups of the key fail with ErrNotFound
+// meanwhile, without calling the fetcher. Other errors are never cached,
+// as they may be transient.
+// Disabled by default.
+func WithNegativeTTL(ttl time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.negativeTTL = ttl
+	}
+}
+
+// Keep serving a value for up to window after it expires, while it is
+// refreshed in the background. Callers never wait for a hot key to be
+// loaded again, at the cost of a value up to window too old.
+// Disabled by default.
+func WithStaleWhileRevalidate(window time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.staleWindow = window
+	}
+}
+
+// Refresh a value in the background when it is read less than before
+// ahead of its expiration, so that a key read often never expires.
+// Keys nobody reads are left to expire.
+// Disabled by default.
+func WithRefreshAhead(before time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.refreshAhead = before
+	}
+}
+
+// Set how often expired entries are swept in the background.
+// Pass 0 to rely on lazy expiration only.
+func WithSweepInterval(interval time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.sweepInterval = interval
+	}
 }
 
 // global variables
@@ -52,7 +279,7 @@ func GetController(name string) *Controller {
 	return controllers[name]
 }
 
-func NewController(name string, maxBytes int64, getter Fetcher) *Controller {
+func NewController(name string, maxBytes int64, getter Fetcher, opts ...ControllerOption) *Controller {
 	if getter == nil {
 		panic("nil getter")
 	}
@@ -61,32 +288,444 @@ func NewController(name string, maxBytes int64, getter Fetcher) *Controller {
 	mu.Lock()
 	defer mu.Unlock()
 
-	controller := &Controller{name: name, fetcher: getter, mainCache: cache{maxBytes: maxBytes}, sfloader: &singleflight.Group{}}
+	controller := &Controller{
+		name:          name,
+		fetcher:       getter,
+		maxBytes:      maxBytes,
+		hotSampling:   DEFAULT_HOT_CACHE_SAMPLING,
+		sfloader:      &singleflight.Group{},
+		sweepInterval: DEFAULT_SWEEP_INTERVAL,
+		stop:          make(chan struct{}),
+		shards:        1,
+	}
+	for _, opt := range opts {
+		opt(controller)
+	}
+	if controller.logger == nil {
+		controller.logger = defaultLogger()
+	}
+	controller.limiter.init()
+	// the caches depend on the options, so create them afterwards
+	controller.mainCache = newCache(maxBytes, controller.shards, controller.policy)
+	controller.hotCache = newCache(maxBytes/HOT_CACHE_RATIO, controller.shards, controller.policy)
 	controllers[name] = controller
 
+	if controller.sweepInterval > 0 {
+		go controller.mainCache.sweepEvery(controller.sweepInterval, controller.stop)
+		go controller.hotCache.sweepEvery(controller.sweepInterval, controller.stop)
+	}
+
 	return controller
 }
 
+// Stop the background work of the controller, i.e. the sweepers.
+// Call it once done with a controller that does not live as long as the
+// program, e.g. in tests, or its goroutines leak.
+// The controller still serves lookups afterwards, expired entries are
+// only dropped lazily then. Calling it again does nothing
+func (c *Controller) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
 // Get value for a key from cache
 func (c *Controller) Get(key string) (ByteView, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// Get value for a key from cache.
+// The context is handed over to peers and to the fetcher on a miss,
+// so a slow load can be cancelled or bounded by a deadline.
+func (c *Controller) GetContext(ctx context.Context, key string) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
 
+	c.stats.gets.Add(1)
+	if v, ok := c.lookupCache(key); ok {
+		return v.result(key)
+	}
+
+	c.stats.loads.Add(1)
+	return c.load(ctx, key)
+}
+
+// Look the key up in both caches
+func (c *Controller) lookupCache(key string) (ByteView, bool) {
 	if v, ok := c.mainCache.get(key); ok {
-		log.Println("[GeeCache] hit")
-		return v, nil
+		c.stats.cacheHits.Add(1)
+		c.logger.Debug("cache hit", "controller", c.name, "key", key)
+		c.refreshIfDue(key, v, c.mainCache)
+		return v, true
+	}
+	if v, ok := c.hotCache.get(key); ok {
+		c.stats.cacheHits.Add(1)
+		c.logger.Debug("hot cache hit", "controller", c.name, "key", key)
+		c.refreshIfDue(key, v, c.hotCache)
+		return v, true
 	}
+	return ByteView{}, false
+}
 
-	val, err := c.sfloader.Do(key, func() (interface{}, error) {
-		return c.fetch(key)
+// Load a key missed by both caches, together with the concurrent
+// callers asking for it
+func (c *Controller) load(ctx context.Context, key string) (ByteView, error) {
+	// whether this caller ran the load, rather than joined one in flight.
+	// Only read once the result is received, after fn returned
+	leader := false
+	ch := c.sfloader.DoChan(key, func() (interface{}, error) {
+		// only one of the concurrent callers gets here
+		leader = true
+		// caveat: callers waiting for the same key share the context of
+		// the first one. If it is cancelled, all of them get the error
+		return c.fetch(ctx, key)
 	})
 
-	if err == nil {
-		return val.(ByteView), err
+	// every caller can stop waiting when its own context is done.
+	// A panic of the fetcher comes as an error too
+	select {
+	case res := <-ch:
+		if !leader {
+			c.stats.loadsDeduped.Add(1)
+		}
+		if res.Err != nil {
+			return ByteView{}, res.Err
+		}
+		return res.Val.(ByteView), nil
+	case <-ctx.Done():
+		return ByteView{}, ctx.Err()
+	}
+}
+
+// Get the values of many keys at once.
+// The keys missing from the caches are grouped by owner: one request
+// goes to each peer, and the keys of the current node are handed to the
+// fetcher in a single call if it is a BatchFetcher.
+// Keys that do not exist are left out of the map. Other failures are
+// joined in the error, the keys that succeeded are still returned
+func (c *Controller) GetMulti(keys []string) (map[string]ByteView, error) {
+	return c.GetMultiContext(context.Background(), keys)
+}
+
+// Same as GetMulti, the context is handed over like in GetContext
+func (c *Controller) GetMultiContext(ctx context.Context, keys []string) (map[string]ByteView, error) {
+	results := c.GetMultiResults(ctx, keys)
+
+	values := make(map[string]ByteView, len(results))
+	var errs []error
+	// in the order of the keys, so that the error reads the same each time
+	done := make(map[string]bool, len(results))
+	for _, key := range keys {
+		if done[key] {
+			continue
+		}
+		done[key] = true
+		switch res := results[key]; {
+		case res.Err == nil:
+			values[key] = res.Value
+		case errors.Is(res.Err, ErrNotFound):
+		default:
+			errs = append(errs, fmt.Errorf("key %q: %w", key, res.Err))
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+// the keys to ask a peer for, see GetMultiResults
+type peerBatch struct {
+	peer RemotePeer
+	// whether the current node is a replica of the keys
+	replica bool
+	keys    []string
+}
+
+// Batches are grouped by peerID rather than by the peer itself:
+// a peer that is not comparable can't be a map key
+type batchKey struct {
+	peer    string
+	replica bool
+}
+
+// Same as GetMultiContext, but tells the outcome of each key, e.g. for
+// transports that answer peers key by key.
+// The misses are looked up in parallel, duplicates only once
+func (c *Controller) GetMultiResults(ctx context.Context, keys []string) map[string]LookupResult {
+	results := make(map[string]LookupResult, len(keys))
+	// the misses, by the way they are loaded
+	var local, each []string
+	batches := make(map[batchKey]*peerBatch)
+
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if key == "" {
+			results[key] = LookupResult{Err: fmt.Errorf("key is required")}
+			continue
+		}
+		c.stats.gets.Add(1)
+		if v, ok := c.lookupCache(key); ok {
+			value, err := v.result(key)
+			results[key] = LookupResult{Value: value, Err: err}
+			continue
+		}
+		c.stats.loads.Add(1)
+
+		// the same decisions as fetch, for the first step only:
+		// the keys that fail take the single key path from there
+		switch peers, self := c.ownersOfKey(key); {
+		case isFallback(ctx) || self == 0:
+			local = append(local, key)
+		case self < 0 && len(peers) == 0:
+			// every owner is down, let fetch find the stand-in
+			each = append(each, key)
+		default:
+			id := batchKey{peer: peerID(peers[0]), replica: self > 0}
+			batch, ok := batches[id]
+			if !ok {
+				batch = &peerBatch{peer: peers[0], replica: self > 0}
+				batches[id] = batch
+			}
+			batch.keys = append(batch.keys, key)
+		}
+	}
+
+	if _, ok := c.fetcher.(BatchFetcher); !ok {
+		each = append(each, local...)
+		local = nil
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	run := func(load func() map[string]LookupResult) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			partial := load()
+			mu.Lock()
+			defer mu.Unlock()
+			for key, res := range partial {
+				results[key] = res
+			}
+		}()
+	}
+
+	if len(local) > 0 {
+		run(func() map[string]LookupResult { return c.fetchMultiLocally(ctx, local) })
+	}
+	for _, batch := range batches {
+		run(func() map[string]LookupResult {
+			return c.fetchMultiFromPeer(ctx, batch.peer, batch.keys, batch.replica)
+		})
+	}
+	if len(each) > 0 {
+		run(func() map[string]LookupResult { return c.loadEach(ctx, each) })
+	}
+	wg.Wait()
+	return results
+}
+
+// Load the keys one by one like GetContext, in parallel
+func (c *Controller) loadEach(ctx context.Context, keys []string) map[string]LookupResult {
+	results := make(map[string]LookupResult, len(keys))
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := c.load(ctx, key)
+			mu.Lock()
+			defer mu.Unlock()
+			results[key] = LookupResult{Value: value, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Start a refresh in the background if the value found in a cache is
+// stale, or about to be
+func (c *Controller) refreshIfDue(key string, value ByteView, cache *cache) {
+	if value.expire.IsZero() || value.notFound {
+		return
+	}
+
+	now := time.Now()
+	stale := now.After(value.expire)
+	if stale {
+		c.stats.staleHits.Add(1)
+	}
+	if !stale && (c.refreshAhead <= 0 || now.Before(value.expire.Add(-c.refreshAhead))) {
+		return
+	}
+
+	// it joins a load of the key in flight, and the next hits join it,
+	// so a key is refreshed once at a time. Nobody waits for the result
+	c.sfloader.DoChan(key, func() (interface{}, error) {
+		c.stats.refreshes.Add(1)
+		// the caller may be gone long before the refresh is done
+		value, err := c.fetch(context.Background(), key)
+		if err != nil {
+			c.logger.Warn("refresh failed", "controller", c.name, "key", key, "err", err)
+			return value, err
+		}
+		// fetch only keeps a sample of the values from peers.
+		// The refreshed one must replace the stale one
+		if cache == c.hotCache {
+			c.populateCache(key, value, c.hotCache)
+		}
+		c.logger.Debug("refreshed", "controller", c.name, "key", key)
+		return value, nil
+	})
+}
+
+// Invalidate a key on the current node and on the peers that own it.
+// Call this once the source of truth of the key has changed.
+// The local copy is always dropped, even if the owners cannot be reached.
+func (c *Controller) Remove(key string) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	c.RemoveLocally(key)
+
+	owners, _ := c.ownersOfKey(key)
+	var errs []error
+	for _, peer := range owners {
+		if err := removeFromPeer(peer, c.name, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Invalidate a key on every node of the cluster.
+// Only works when the registered PeerDict is a PeerLister,
+// otherwise it behaves like Remove
+func (c *Controller) RemoveEverywhere(key string) error {
+	lister, ok := c.peers.(PeerLister)
+	if !ok {
+		return c.Remove(key)
+	}
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+
+	c.RemoveLocally(key)
+
+	// keep going when one peer fails, so that as many copies as
+	// possible are dropped. Report all the failures at the end
+	var errs []error
+	for _, peer := range lister.AllPeers() {
+		if err := removeFromPeer(peer, c.name, key); err != nil {
+			errs = append(errs, err)
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	return ByteView{}, err
+// Store a value computed by the caller, e.g. right after writing it to
+// the database, so that the next Get does not have to fetch it.
+// The value expires after the default ttl of the controller
+func (c *Controller) Set(key string, value []byte) error {
+	return c.SetWithTTL(key, value, 0)
+}
+
+// Same as Set, the ttl follows the same rules as TTLFetcher.
+// The value is written to the peers that own the key, and kept on the
+// current node only if it is one of them.
+// Any owner that missed the write is an error, since it may serve the old
+// value until it expires. The error says so when no owner got it at all.
+// caveat: a load of the key already in flight may still overwrite it
+// with what the fetcher returns
+func (c *Controller) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+
+	// the caller may reuse its slice
+	clone := make([]byte, len(value))
+	copy(clone, value)
+	view := ByteView{value: clone}
+	if ttl > 0 {
+		view.expire = time.Now().Add(ttl)
+	}
+
+	owners, self := c.ownersOfKey(key)
+	if self >= 0 {
+		c.SetLocally(key, view)
+	} else {
+		// a copy in hotCache is stale now
+		c.RemoveLocally(key)
+	}
+
+	// the current node counts when it is an owner
+	stored := self >= 0
+	var errs []error
+	for _, peer := range owners {
+		if err := setOnPeer(peer, c.name, key, view); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		stored = true
+	}
+	if !stored && len(errs) == 0 {
+		// e.g. a ring without any node
+		return fmt.Errorf("%s has no owner to write to", key)
+	}
+	if !stored {
+		return fmt.Errorf("no owner of %s took the write: %w", key, errors.Join(errs...))
+	}
+	return errors.Join(errs...)
+}
+
+// Store the key on the current node only, as one of its owners.
+// Transports call it when a peer writes the key, see WritablePeer.
+// Use Set otherwise, so that the owners get the key as well
+func (c *Controller) SetLocally(key string, value ByteView) {
+	// later lookups must not wait for a load started before the write
+	c.sfloader.Forget(key)
+	c.hotCache.remove(key)
+	c.populateCache(key, value, c.mainCache)
+}
+
+// Drop the key from the caches of the current node only.
+// Transports call it when a peer invalidates the key, see RemovablePeer.
+// Use Remove otherwise, so that the owners drop the key as well
+func (c *Controller) RemoveLocally(key string) {
+	// later lookups must not wait for a load started before the removal
+	c.sfloader.Forget(key)
+	c.mainCache.remove(key)
+	c.hotCache.remove(key)
+}
+
+// A snapshot of the counters of the controller
+func (c *Controller) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// A snapshot of the counters of one of the caches
+func (c *Controller) CacheStats(which CacheType) CacheStats {
+	switch which {
+	case MainCache:
+		return c.mainCache.snapshot()
+	case HotCache:
+		return c.hotCache.snapshot()
+	default:
+		return CacheStats{}
+	}
 }
 
 func (c *Controller) RegisterPeers(peers PeerDict) {
@@ -96,37 +735,313 @@ func (c *Controller) RegisterPeers(peers PeerDict) {
 	c.peers = peers
 }
 
-func (c *Controller) fetch(key string) (ByteView, error) {
-
+// The peers that own the key, primary first, and the position of the
+// current node among them, -1 when it is not an owner.
+// Without a ReplicaPeerDict, a key has a single owner
+func (c *Controller) ownersOfKey(key string) ([]RemotePeer, int) {
+	if replicas, ok := c.peers.(ReplicaPeerDict); ok {
+		return replicas.OwnersOfKey(key)
+	}
 	if c.peers != nil {
-		// there are registered peers
-		// we try to fetch from peers first
 		// if the key is assigned to current node, ok would be `false`
-		// this can correctly force the current node to fetch if missed
 		if peer, ok := c.peers.PeerOfKey(key); ok {
-			if value, err := c.fetchFromPeer(peer, key); err == nil {
+			return []RemotePeer{peer}, -1
+		}
+	}
+	// no peers at all, the current node owns everything
+	return nil, 0
+}
+
+func (c *Controller) fetch(ctx context.Context, key string) (ByteView, error) {
+	// another node asked the current one to stand in for the owners.
+	// They are down as far as it knows, and asking anyone else could
+	// bounce the key around the cluster
+	if isFallback(ctx) {
+		return c.fetchLocally(ctx, key)
+	}
+
+	// ask the owners before the current node, the primary first.
+	// An owner loads the key itself rather than asking the next ones
+	peers, self := c.ownersOfKey(key)
+	// whether the current node is a replica of the key
+	replica := false
+	if self >= 0 {
+		peers = peers[:self]
+		replica = self > 0
+	}
+
+	for _, peer := range peers {
+		// it just failed to answer this key in a batch
+		if isSkipped(ctx, peer) {
+			continue
+		}
+		start := time.Now()
+		value, err := c.fetchFromPeer(ctx, peer, key, replica)
+		if err == nil {
+			c.stats.peerLoads.Add(1)
+			c.logger.Debug("loaded from peer",
+				"controller", c.name, "key", key, "peer", peer, "latency", time.Since(start))
+			return value, nil
+		}
+		// the owner has an answer, it's just a negative one.
+		// Loading locally would ask the backend again.
+		// So would a load the owner shed, defeating the point of shedding
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrLoadShed) {
+			c.stats.peerLoads.Add(1)
+			c.logger.Debug("not found by peer",
+				"controller", c.name, "key", key, "peer", peer, "latency", time.Since(start))
+			return ByteView{}, err
+		}
+		// the peer is known to be down, nothing was sent
+		if errors.Is(err, errCircuitOpen) {
+			c.logger.Debug("skip unhealthy peer", "controller", c.name, "key", key, "peer", peer)
+			continue
+		}
+		c.stats.peerErrors.Add(1)
+		c.logger.Warn("cannot hear from peer",
+			"controller", c.name, "key", key, "peer", peer, "latency", time.Since(start), "err", err)
+
+		// no point to ask the next replica for a caller that gave up
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// the peer may have failed because the caller gave up.
+	// Then loading locally is wasted effort
+	if err := ctx.Err(); err != nil {
+		return ByteView{}, err
+	}
+
+	// No owner answered, and the current node is not one of them.
+	// Every node asking for the key is in the same situation: leave the
+	// load to the stand-in, which merges their requests into one
+	if fallbacks, ok := c.peers.(FallbackPeerDict); ok && self < 0 {
+		if peer, ok := fallbacks.FallbackOfKey(key); ok && !isSkipped(ctx, peer) {
+			start := time.Now()
+			value, err := c.fetchFromPeer(withFallback(ctx), peer, key, false)
+			if err == nil {
+				c.stats.peerLoads.Add(1)
+				c.logger.Debug("loaded from fallback peer",
+					"controller", c.name, "key", key, "peer", peer, "latency", time.Since(start))
 				return value, nil
 			}
-			log.Println("Cannot hear from peers")
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrLoadShed) {
+				return ByteView{}, err
+			}
+			c.stats.peerErrors.Add(1)
+			c.logger.Warn("cannot hear from fallback peer",
+				"controller", c.name, "key", key, "peer", peer, "latency", time.Since(start), "err", err)
+			if err := ctx.Err(); err != nil {
+				return ByteView{}, err
+			}
+		}
+	}
+	// the last resort
+	return c.fetchLocally(ctx, key)
+}
+
+// the key of the context value marking a fallback request
+type fallbackKey struct{}
+
+// Mark a request to a peer as a fallback: the peer must load the key
+// itself, whoever owns it
+func withFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, fallbackKey{}, true)
+}
+
+func isFallback(ctx context.Context) bool {
+	fallback, _ := ctx.Value(fallbackKey{}).(bool)
+	return fallback
+}
+
+// the key of the context value naming a peer fetch must not ask
+type skipPeerKey struct{}
+
+// Mark a load that must not ask the peer, e.g. the keys a batch request
+// to it failed to get. fetch moves on to the other owners, the stand-in
+// and the current node, as if the peer had failed on this key already
+func withoutPeer(ctx context.Context, peer RemotePeer) context.Context {
+	return context.WithValue(ctx, skipPeerKey{}, peerID(peer))
+}
+
+func isSkipped(ctx context.Context, peer RemotePeer) bool {
+	skipped, ok := ctx.Value(skipPeerKey{}).(string)
+	return ok && skipped == peerID(peer)
+}
+
+// Tells peers apart: by String when they have one, e.g. the url of an
+// httpClient, by their address otherwise.
+// Unlike the peer itself, it works for peers that are not comparable
+func peerID(peer RemotePeer) string {
+	if s, ok := peer.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T %p", peer, peer)
+}
+
+func (c *Controller) fetchFromPeer(ctx context.Context, peer RemotePeer, key string, replica bool) (ByteView, error) {
+	value, err := lookupPeer(ctx, peer, c.name, key)
+	if err != nil {
+		return ByteView{}, err
+	}
+	c.keepFromPeer(key, value, replica)
+	return value, nil
+}
+
+// Ask a peer for many keys in a single request, or key by key when it
+// can't answer batches, see lookupPeerMulti.
+// The keys it does not answer take the long way, one by one through
+// the other owners, the stand-in and the current node, but not this peer
+func (c *Controller) fetchMultiFromPeer(ctx context.Context, peer RemotePeer, keys []string, replica bool) map[string]LookupResult {
+	start := time.Now()
+	answers, err := lookupPeerMulti(ctx, peer, c.name, keys)
+	if err == nil && len(answers) != len(keys) {
+		err = fmt.Errorf("expect %d results, got %d", len(keys), len(answers))
+	}
+	if err != nil {
+		// nothing was sent to a peer known to be down, see fetch
+		if errors.Is(err, errCircuitOpen) {
+			c.logger.Debug("skip unhealthy peer", "controller", c.name, "keys", len(keys), "peer", peer)
+		} else {
+			c.stats.peerErrors.Add(1)
+			c.logger.Warn("cannot hear from peer",
+				"controller", c.name, "keys", len(keys), "peer", peer, "latency", time.Since(start), "err", err)
+		}
+		// the peer failed, asking it again key by key would only fail more
+		return c.loadEach(withoutPeer(ctx, peer), keys)
+	}
+	c.logger.Debug("loaded batch from peer",
+		"controller", c.name, "keys", len(keys), "peer", peer, "latency", time.Since(start))
+
+	results := make(map[string]LookupResult, len(keys))
+	var retry []string
+	for i, key := range keys {
+		value, err := answers[i].Value, answers[i].Err
+		switch {
+		case err == nil:
+			c.keepFromPeer(key, value, replica)
+		// final answers, see fetch
+		case errors.Is(err, ErrNotFound) || errors.Is(err, ErrLoadShed):
+		default:
+			retry = append(retry, key)
+			continue
 		}
+		c.stats.peerLoads.Add(1)
+		results[key] = LookupResult{Value: value, Err: err}
+	}
+	for key, res := range c.loadEach(withoutPeer(ctx, peer), retry) {
+		results[key] = res
 	}
-	return c.fetchLocally(key)
+	return results
 }
 
-func (c *Controller) fetchFromPeer(peer RemotePeer, key string) (ByteView, error) {
-	bytes, err := peer.Get(c.name, key)
+// ask the peer with the richest interface it implements
+func lookupPeer(ctx context.Context, peer RemotePeer, namespace string, key string) (ByteView, error) {
+	var (
+		bytes []byte
+		err   error
+	)
+	switch p := peer.(type) {
+	case LookupPeer:
+		return p.Lookup(ctx, namespace, key)
+	case RemotePeerContext:
+		bytes, err = p.GetContext(ctx, namespace, key)
+	default:
+		// it can't be cancelled, at least don't start it for nobody
+		if err := ctx.Err(); err != nil {
+			return ByteView{}, err
+		}
+		bytes, err = p.Get(namespace, key)
+	}
 	if err != nil {
 		return ByteView{}, err
 	}
 	return ByteView{value: bytes}, nil
 }
 
-func (c *Controller) fetchLocally(key string) (ByteView, error) {
-	bytes, err := c.fetcher.Fetch(key)
+// ask the peer for many keys, in a single request if it can
+func lookupPeerMulti(ctx context.Context, peer RemotePeer, namespace string, keys []string) ([]LookupResult, error) {
+	if p, ok := peer.(BatchPeer); ok {
+		results, err := p.LookupMulti(ctx, namespace, keys)
+		// the peer answered, just not to a batch: ask it the keys one by one
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return results, err
+		}
+	}
+	results := make([]LookupResult, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Value, results[i].Err = lookupPeer(ctx, peer, namespace, key)
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+func removeFromPeer(peer RemotePeer, namespace string, key string) error {
+	p, ok := peer.(RemovablePeer)
+	if !ok {
+		return fmt.Errorf("%v cannot remove keys: %w", peer, errors.ErrUnsupported)
+	}
+	return p.Remove(namespace, key)
+}
+
+func setOnPeer(peer RemotePeer, namespace string, key string, value ByteView) error {
+	p, ok := peer.(WritablePeer)
+	if !ok {
+		return fmt.Errorf("%v cannot store keys: %w", peer, errors.ErrUnsupported)
+	}
+	return p.Set(namespace, key, value)
+}
+
+// A replica keeps the value like the primary does, so that it can take
+// over if the primary is lost
+func (c *Controller) keepFromPeer(key string, value ByteView, replica bool) {
+	if replica {
+		c.populateCache(key, value, c.mainCache)
+		return
+	}
+	// only a sample of the values is kept.
+	// A popular key will be sampled soon enough, while a key requested
+	// once is unlikely to push useful entries out of hotCache
+	if c.hotSampling > 0 && rand.Intn(c.hotSampling) == 0 {
+		c.populateCache(key, value, c.hotCache)
+	}
+}
+
+func (c *Controller) fetchLocally(ctx context.Context, key string) (ByteView, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		if errors.Is(err, ErrLoadShed) {
+			c.stats.loadsShed.Add(1)
+			c.logger.Warn("load shed", "controller", c.name, "key", key, "err", err)
+		}
+		return ByteView{}, err
+	}
+	start := time.Now()
+	bytes, ttl, err := func() ([]byte, time.Duration, error) {
+		// released even if the fetcher panics
+		defer release()
+		defer c.localLoad()()
+		return c.fetchWithTTL(ctx, key)
+	}()
 	if err != nil {
+		c.stats.localLoadErrs.Add(1)
+		c.logger.Debug("fetch failed",
+			"controller", c.name, "key", key, "latency", time.Since(start), "err", err)
+
+		if errors.Is(err, ErrNotFound) {
+			c.rememberNotFound(key)
+		}
 		return ByteView{}, err
 
 	}
+	c.stats.localLoads.Add(1)
+	c.logger.Debug("fetched",
+		"controller", c.name, "key", key, "latency", time.Since(start), "ttl", ttl)
 
 	// we decided to clone the bytes
 	// it may not be the most efficient way
@@ -136,13 +1051,141 @@ func (c *Controller) fetchLocally(key string) (ByteView, error) {
 	copy(clone, bytes)
 
 	value := ByteView{value: clone}
-	c.populateCache(key, value)
+	if ttl > 0 {
+		value.expire = time.Now().Add(ttl)
+	}
+	c.populateCache(key, value, c.mainCache)
 	return value, nil
 }
 
-// add some data to the cache manually
-// primarily for testing
-// it is not recommend to use this in production
-func (g *Controller) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value)
+// Load many keys with a single call to the BatchFetcher.
+// caveat: unlike single loads, it does not merge with concurrent loads
+// of the same keys
+func (c *Controller) fetchMultiLocally(ctx context.Context, keys []string) map[string]LookupResult {
+	results := make(map[string]LookupResult, len(keys))
+	failAll := func(err error) map[string]LookupResult {
+		for _, key := range keys {
+			results[key] = LookupResult{Err: err}
+		}
+		return results
+	}
+
+	// a batch is a single call to the source, it takes a single slot
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		if errors.Is(err, ErrLoadShed) {
+			c.stats.loadsShed.Add(int64(len(keys)))
+			c.logger.Warn("load shed", "controller", c.name, "keys", len(keys), "err", err)
+		}
+		return failAll(err)
+	}
+	start := time.Now()
+	values, ttl, err := func() (map[string][]byte, time.Duration, error) {
+		// released even if the fetcher panics.
+		// Like a batch request to a peer, it counts as one load
+		defer release()
+		defer c.localLoad()()
+		return c.fetcher.(BatchFetcher).FetchMulti(ctx, keys)
+	}()
+	if err != nil {
+		c.stats.localLoadErrs.Add(int64(len(keys)))
+		c.logger.Debug("batch fetch failed",
+			"controller", c.name, "keys", len(keys), "latency", time.Since(start), "err", err)
+		return failAll(err)
+	}
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	c.logger.Debug("fetched batch",
+		"controller", c.name, "keys", len(keys), "latency", time.Since(start), "ttl", ttl)
+
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+	for _, key := range keys {
+		bytes, ok := values[key]
+		if !ok {
+			c.stats.localLoadErrs.Add(1)
+			c.rememberNotFound(key)
+			results[key] = LookupResult{Err: fmt.Errorf("%s: %w", key, ErrNotFound)}
+			continue
+		}
+		c.stats.localLoads.Add(1)
+		// same as fetchLocally, the fetcher may reuse its slices
+		clone := make([]byte, len(bytes))
+		copy(clone, bytes)
+		value := ByteView{value: clone, expire: expire}
+		c.populateCache(key, value, c.mainCache)
+		results[key] = LookupResult{Value: value}
+	}
+	return results
+}
+
+// Tell the peers the current node is loading, if they balance loads.
+// Call the returned function once done
+func (c *Controller) localLoad() (done func()) {
+	if tracker, ok := c.peers.(LoadTrackingPeerDict); ok {
+		return tracker.LocalLoad()
+	}
+	return func() {}
+}
+
+// Remember that the key does not exist, if negative caching is enabled
+func (c *Controller) rememberNotFound(key string) {
+	if c.negativeTTL > 0 {
+		c.populateCache(key, ByteView{notFound: true, expire: time.Now().Add(c.negativeTTL)}, c.mainCache)
+	}
+}
+
+// call the user fetcher with the richest interface it implements
+func (c *Controller) fetchWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	var (
+		bytes []byte
+		ttl   time.Duration
+		err   error
+	)
+	switch f := c.fetcher.(type) {
+	case FetcherContext:
+		bytes, ttl, err = f.FetchContext(ctx, key)
+	case TTLFetcher:
+		bytes, ttl, err = f.FetchWithTTL(key)
+	default:
+		bytes, err = f.Fetch(key)
+	}
+
+	if ttl == 0 {
+		ttl = c.ttl
+	}
+	return bytes, ttl, err
+}
+
+// add some data to one of the caches
+// and keep both of them within the shared maxBytes
+func (g *Controller) populateCache(key string, value ByteView, cache *cache) {
+	if g.staleWindow > 0 && !value.expire.IsZero() && !value.notFound {
+		value.staleUntil = value.expire.Add(g.staleWindow)
+	}
+	cache.add(key, value)
+
+	if g.maxBytes == 0 {
+		return
+	}
+
+	// Both caches share the same budget.
+	// Evict from hotCache when it takes more than its share of mainCache,
+	// so that the keys this node owns are preferred.
+	for {
+		mainBytes := g.mainCache.bytes()
+		hotBytes := g.hotCache.bytes()
+		if mainBytes+hotBytes <= g.maxBytes {
+			return
+		}
+
+		victim := g.mainCache
+		if hotBytes > mainBytes/HOT_CACHE_RATIO {
+			victim = g.hotCache
+		}
+		victim.removeOldest()
+	}
 }
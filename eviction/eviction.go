@@ -0,0 +1,53 @@
+/*
+The contract between the cache and the data structures deciding which
+entry to drop when the cache is full.
+QECache/lru is the default one, QECache/lfu, QECache/arc, QECache/twoq
+and QECache/tinylfu are the alternatives.
+*/
+package eviction
+
+import "time"
+
+// The value saved in a policy. Allow arbitrary type in principle.
+type Value interface {
+	Len() int // how many bytes it takes
+}
+
+// An eviction policy is a bounded dictionary.
+// It decides by itself which entry to drop once maxBytes is exceeded.
+// Implementations are not safe for concurrent access.
+type Policy interface {
+	Get(key string) (value Value, ok bool)
+	// Add an entry that never expires
+	Add(key string, value Value)
+	// Add an entry that expires after ttl. ttl <= 0 means never
+	AddWithTTL(key string, value Value, ttl time.Duration)
+	// Remove an entry on purpose. Returns whether it was there
+	Remove(key string) bool
+	// Evict the one entry that the policy values the least
+	RemoveOldest()
+	// Drop every expired entry, returns how many were dropped
+	RemoveExpired() int
+	// how many entries are there
+	Len() int
+	// how many bytes the keys and values take
+	UsedBytes() int64
+}
+
+// Creates a policy. Give 0 maxBytes for assuming infinite capacity.
+// onEvicted is optional and executed when an entry is purged
+type Factory func(maxBytes int64, onEvicted func(key string, value Value)) Policy
+
+// When an entry added at `now` with ttl expires.
+// The zero time means it never does
+func ExpireAt(now time.Time, ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
+
+// Whether an entry with the expire time is stale at `now`
+func Expired(expire time.Time, now time.Time) bool {
+	return !expire.IsZero() && !now.Before(expire)
+}
@@ -0,0 +1,121 @@
+// Tests every policy against the same contract,
+// and compares their hit ratios on a Zipfian trace.
+// It lives in a separate package so that it can import the policies
+// the way users see them
+package eviction_test
+
+import (
+	"QECache"
+	"QECache/eviction"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+// the policies a controller can choose from, see policy.go
+var policies = qecache.EvictionPolicies
+
+func TestGetAddRemove(t *testing.T) {
+	for name, newPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			p := newPolicy(0, nil)
+			p.Add("key1", String("1234"))
+			if v, ok := p.Get("key1"); !ok || string(v.(String)) != "1234" {
+				t.Fatalf("cache hit key1=1234 failed")
+			}
+			if _, ok := p.Get("key2"); ok {
+				t.Fatalf("cache miss key2 failed")
+			}
+
+			p.Add("key1", String("123456"))
+			if v, _ := p.Get("key1"); string(v.(String)) != "123456" || p.UsedBytes() != 10 {
+				t.Fatalf("update key1 failed, used bytes %d", p.UsedBytes())
+			}
+
+			if !p.Remove("key1") || p.Len() != 0 || p.UsedBytes() != 0 {
+				t.Fatalf("remove key1 failed")
+			}
+		})
+	}
+}
+
+func TestBudget(t *testing.T) {
+	for name, newPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			evicted := 0
+			p := newPolicy(100, func(string, eviction.Value) { evicted++ })
+			for i := 0; i < 100; i++ {
+				p.Add(fmt.Sprintf("k%02d", i), String("1234567"))
+				if p.UsedBytes() > 100 {
+					t.Fatalf("used %d bytes, more than the budget", p.UsedBytes())
+				}
+			}
+			if p.Len()+evicted != 100 {
+				t.Fatalf("every entry should be either kept or evicted, kept %d evicted %d", p.Len(), evicted)
+			}
+
+			len := p.Len()
+			p.RemoveOldest()
+			if p.Len() != len-1 {
+				t.Fatalf("remove oldest failed")
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	for name, newPolicy := range policies {
+		t.Run(name, func(t *testing.T) {
+			p := newPolicy(0, nil)
+			p.AddWithTTL("short", String("1"), time.Millisecond)
+			p.AddWithTTL("other", String("1"), time.Millisecond)
+			p.Add("forever", String("2"))
+
+			time.Sleep(5 * time.Millisecond)
+			if _, ok := p.Get("short"); ok {
+				t.Fatalf("short should have expired")
+			}
+			if removed := p.RemoveExpired(); removed != 1 || p.Len() != 1 {
+				t.Fatalf("expect 1 entry swept, got %d", removed)
+			}
+		})
+	}
+}
+
+// Every key is about as long, so bytes are proportional to entries.
+// The cache holds about 1% of the key space
+func benchmarkZipf(b *testing.B, newPolicy eviction.Factory) {
+	const keys = 100000
+	r := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(r, 1.01, 1, keys-1)
+	trace := make([]string, 1<<18)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("key%06d", zipf.Uint64())
+	}
+
+	p := newPolicy(int64(len("key000000")+len("v"))*keys/100, nil)
+	hits := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := trace[i%len(trace)]
+		if _, ok := p.Get(key); ok {
+			hits++
+		} else {
+			p.Add(key, String("v"))
+		}
+	}
+	b.ReportMetric(float64(hits)/float64(b.N)*100, "hit%")
+}
+
+func BenchmarkZipfLRU(b *testing.B)     { benchmarkZipf(b, policies["lru"]) }
+func BenchmarkZipfLFU(b *testing.B)     { benchmarkZipf(b, policies["lfu"]) }
+func BenchmarkZipfARC(b *testing.B)     { benchmarkZipf(b, policies["arc"]) }
+func BenchmarkZipf2Q(b *testing.B)      { benchmarkZipf(b, policies["2q"]) }
+func BenchmarkZipfTinyLFU(b *testing.B) { benchmarkZipf(b, policies["tinylfu"]) }
@@ -3,4 +3,5 @@ module example/http
 go 1.23.1
 
 require QECache v0.0.0
-replace QECache => ../../.
\ No newline at end of file
+
+replace QECache => ../../.
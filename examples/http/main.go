@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 var db = map[string]string{
@@ -20,8 +21,9 @@ func main() {
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
-		}))
+			// wrap ErrNotFound so that the miss is remembered for a while
+			return nil, fmt.Errorf("%s not exist: %w", key, qecache.ErrNotFound)
+		}), qecache.WithNegativeTTL(time.Minute))
 
 	addr := "localhost:9998"
 	peers := qecache.NewHTTPServer(qecache.HTTPServerConfig{
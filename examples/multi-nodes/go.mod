@@ -1,5 +1,7 @@
 module example/multi-nodes
 
 go 1.23.1
+
 require QECache v0.0.0
-replace QECache => ../../.
\ No newline at end of file
+
+replace QECache => ../../.
@@ -2,10 +2,13 @@ package main
 
 import (
 	qecache "QECache"
+	"QECache/membership"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 )
 
 var db = map[string]string{
@@ -21,18 +24,52 @@ func createController() *qecache.Controller {
 			if v, ok := db[key]; ok {
 				return []byte(v), nil
 			}
-			return nil, fmt.Errorf("%s not exist", key)
-		}))
+			// wrap ErrNotFound so that the miss is remembered for a while
+			return nil, fmt.Errorf("%s not exist: %w", key, qecache.ErrNotFound)
+		}), qecache.WithNegativeTTL(time.Minute))
 }
 
-func startCacheServer(addr string, addrs []string, gee *qecache.Controller) {
+// Peers find each other by gossip, a node only needs to know a seed.
+// The first node has no seed, the cluster grows from it
+func startCacheServer(addr string, seed string, gee *qecache.Controller) {
 	peers := qecache.NewHTTPServer(qecache.HTTPServerConfig{
 		SelfIP: addr,
 	})
-	peers.SetPeers(addrs...)
 	gee.RegisterPeers(peers)
+
+	// the ring follows the members: peers are added when they join
+	// and removed when they leave
+	members := membership.New(membership.Config{
+		Self:  addr,
+		Peers: peers,
+		OnJoin: func(peer string) {
+			log.Println("join:", peer)
+		},
+		OnLeave: func(peer string) {
+			log.Println("leave:", peer)
+		},
+	})
+
+	// both APIs are served on the same port
+	mux := http.NewServeMux()
+	mux.Handle(membership.DEFAULT_PATH, members)
+	mux.Handle("/", peers)
+
+	go func() {
+		if seed == "" {
+			members.Start()
+			return
+		}
+		// the seed may not be up yet
+		for err := members.Join(seed); err != nil; err = members.Join(seed) {
+			log.Println(err)
+			time.Sleep(time.Second)
+		}
+		members.Start()
+	}()
+
 	log.Println("qecache is running at", addr)
-	log.Fatal(http.ListenAndServe(addr[7:], peers))
+	log.Fatal(http.ListenAndServe(addr[7:], mux))
 }
 
 func startAPIServer(apiAddr string, gee *qecache.Controller) {
@@ -40,6 +77,10 @@ func startAPIServer(apiAddr string, gee *qecache.Controller) {
 		func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
 			view, err := gee.Get(key)
+			if errors.Is(err, qecache.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
@@ -56,25 +97,18 @@ func startAPIServer(apiAddr string, gee *qecache.Controller) {
 func main() {
 	var port int
 	var api bool
+	var seed string
 	flag.IntVar(&port, "port", 8001, "Geecache server port")
 	flag.BoolVar(&api, "api", false, "Start a api server?")
+	flag.StringVar(&seed, "seed", "", "Address of any node of the cluster to join")
 	flag.Parse()
 
 	apiAddr := "http://localhost:9999"
-	addrMap := map[int]string{
-		8001: "http://localhost:8001",
-		8002: "http://localhost:8002",
-		8003: "http://localhost:8003",
-	}
-
-	var addrs []string
-	for _, v := range addrMap {
-		addrs = append(addrs, v)
-	}
+	addr := fmt.Sprintf("http://localhost:%d", port)
 
 	gee := createController()
 	if api {
 		go startAPIServer(apiAddr, gee)
 	}
-	startCacheServer(addrMap[port], []string(addrs), gee)
+	startCacheServer(addr, seed, gee)
 }
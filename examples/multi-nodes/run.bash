@@ -5,10 +5,11 @@ trap "rm server;kill 0" EXIT
 
 go build -o server
 ./server -port=8001 &
-./server -port=8002 &
-./server -port=8003 -api=1 &
+./server -port=8002 -seed=http://localhost:8001 &
+./server -port=8003 -seed=http://localhost:8001 -api=1 &
 
-sleep 2
+# wait for the gossip to spread
+sleep 4
 echo ">>> start test"
 curl "http://localhost:9999/api?key=Tom" &
 curl "http://localhost:9999/api?key=Tom" &
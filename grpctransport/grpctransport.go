@@ -0,0 +1,420 @@
+// A gRPC transport, as an alternative to qecache.HTTPServer.
+// It lives in its own package so that only its users depend on gRPC.
+// The service is described by hand instead of generated by protoc:
+// messages are the wire envelopes, carried by a codec of our own.
+//
+// caveat: it only routes each key to a single owner, on a plain
+// consistent hash ring. Placements, weights, replicas, circuit breakers
+// and fallback peers are only supported by qecache.HTTPServer
+package grpctransport
+
+import (
+	"QECache"
+	"QECache/consistenthash"
+	"QECache/wire"
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcencoding "google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// ======================================
+// Codec
+// gRPC picks the codec by the content-subtype of a call,
+// e.g. application/grpc+qecache
+// ======================================
+
+const CODEC_NAME = "qecache"
+
+type wireCodec struct{}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("cannot marshal %T", v)
+	}
+	return m.MarshalBinary()
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal %T", v)
+	}
+	return m.UnmarshalBinary(data)
+}
+
+func (wireCodec) Name() string {
+	return CODEC_NAME
+}
+
+// init runs once when the package is loaded
+func init() {
+	grpcencoding.RegisterCodec(wireCodec{})
+}
+
+// ======================================
+// gRPC Client
+// Implements qecache.RemotePeer and all its optional interfaces
+// ======================================
+
+const (
+	methodGet    = "/qecache.Cache/Get"
+	methodRemove = "/qecache.Cache/Remove"
+	methodSet    = "/qecache.Cache/Set"
+	// a lookup of many keys, see Controller.GetMulti
+	methodGetMulti = "/qecache.Cache/GetMulti"
+)
+
+type client struct {
+	addr string
+	conn *grpc.ClientConn
+	// bounds every call, on top of the deadline of its context if any.
+	// 0 means no bound
+	timeout time.Duration
+}
+
+// Send a call with the codec, within the timeout.
+// Remove and Set have no context, the timeout is all that stops them
+// from waiting for a hung peer forever
+func (c *client) invoke(ctx context.Context, method string, req any, res any) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	return c.conn.Invoke(ctx, method, req, res, grpc.CallContentSubtype(CODEC_NAME))
+}
+
+func (c *client) Get(cname string, key string) ([]byte, error) {
+	return c.GetContext(context.Background(), cname, key)
+}
+
+func (c *client) GetContext(ctx context.Context, cname string, key string) ([]byte, error) {
+	view, err := c.Lookup(ctx, cname, key)
+	if err != nil {
+		return nil, err
+	}
+	return view.ByteSlice(), nil
+}
+
+func (c *client) Lookup(ctx context.Context, cname string, key string) (qecache.ByteView, error) {
+	var res wire.Response
+	req := &wire.Request{Namespace: cname, Key: key}
+	if err := c.invoke(ctx, methodGet, req, &res); err != nil {
+		return qecache.ByteView{}, err
+	}
+	return qecache.ViewOfResponse(&res)
+}
+
+func (c *client) Remove(cname string, key string) error {
+	var res wire.Response
+	req := &wire.Request{Namespace: cname, Key: key}
+	if err := c.invoke(context.Background(), methodRemove, req, &res); err != nil {
+		return err
+	}
+	_, err := qecache.ViewOfResponse(&res)
+	return err
+}
+
+func (c *client) Set(cname string, key string, value qecache.ByteView) error {
+	var res wire.Response
+	req := &wire.Request{Namespace: cname, Key: key, Value: value.ByteSlice()}
+	if expire := value.Expire(); !expire.IsZero() {
+		req.Expire = expire.UnixNano()
+	}
+	if err := c.invoke(context.Background(), methodSet, req, &res); err != nil {
+		return err
+	}
+	_, err := qecache.ViewOfResponse(&res)
+	return err
+}
+
+func (c *client) LookupMulti(ctx context.Context, cname string, keys []string) ([]qecache.LookupResult, error) {
+	var res wire.BatchResponse
+	req := &wire.BatchRequest{Namespace: cname, Keys: keys}
+	if err := c.invoke(ctx, methodGetMulti, req, &res); err != nil {
+		// a server of an older version, the controller asks key by key
+		if status.Code(err) == codes.Unimplemented {
+			return nil, fmt.Errorf("%v cannot look up keys in batch, %v: %w", c, err, errors.ErrUnsupported)
+		}
+		return nil, err
+	}
+	return qecache.ResultsOfBatch(keys, &res)
+}
+
+// the peer shows up as its address in logs
+func (c *client) String() string {
+	return c.addr
+}
+
+var _ qecache.RemotePeer = (*client)(nil)
+var _ qecache.RemotePeerContext = (*client)(nil)
+var _ qecache.LookupPeer = (*client)(nil)
+var _ qecache.RemovablePeer = (*client)(nil)
+var _ qecache.WritablePeer = (*client)(nil)
+var _ qecache.BatchPeer = (*client)(nil)
+
+// ======================================
+// gRPC Server
+// Serves the same lookups as qecache.HTTPServer, and picks the owner of
+// a key the same way as its default placement
+// ======================================
+
+// The PeerDict over gRPC: each key has a single owner, picked by
+// consistent hashing over the addresses given to SetPeers.
+// It is not a ReplicaPeerDict nor a FallbackPeerDict, and it has no
+// choice of placement, weights nor circuit breakers: a key is asked to its
+// owner only, even when the owner is down. qecache.HTTPServer has them
+type Server struct {
+	// the address peers dial to reach this node, e.g. localhost:8001
+	selfAddr string
+	mu       sync.Mutex
+	// peer information, used to get entry from peer if cache missed
+	peers *consistenthash.KeyHashInfo
+	// one connection per peer, gRPC multiplexes the calls over it
+	clients map[string]*client
+	// used to dial peers, e.g. credentials
+	dialOptions []grpc.DialOption
+	// bounds each call to a peer
+	timeout time.Duration
+	// where to write logs
+	logger qecache.Logger
+}
+
+type ServerConfig struct {
+	// must provide the address
+	SelfAddr string
+	// optional, used when connecting to peers.
+	// At least the transport credentials are usually needed
+	DialOptions []grpc.DialOption
+	// optional, bounds each call to a peer.
+	// qecache.DEFAULT_PEER_TIMEOUT by default, negative for no timeout
+	Timeout time.Duration
+	// optional, slog.Default() by default
+	Logger qecache.Logger
+}
+
+func NewServer(config ServerConfig) *Server {
+	if config.SelfAddr == "" {
+		panic("Must provide Self Address")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = qecache.DEFAULT_PEER_TIMEOUT
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+	return &Server{
+		selfAddr:    config.SelfAddr,
+		peers:       consistenthash.New(qecache.DEFAULT_VNODE_SCALAR, nil),
+		clients:     make(map[string]*client),
+		dialOptions: config.DialOptions,
+		timeout:     max(config.Timeout, 0),
+		logger:      config.Logger,
+	}
+}
+
+// Register the cache service on a gRPC server.
+// The caller owns the gRPC server: its listener, credentials and lifetime
+func (s *Server) Register(registrar grpc.ServiceRegistrar) {
+	registrar.RegisterService(&serviceDesc, s)
+}
+
+// The interface gRPC checks the registered service against
+type cacheService interface {
+	get(ctx context.Context, req *wire.Request) (*wire.Response, error)
+	remove(ctx context.Context, req *wire.Request) (*wire.Response, error)
+	set(ctx context.Context, req *wire.Request) (*wire.Response, error)
+	getMulti(ctx context.Context, req *wire.BatchRequest) (*wire.BatchResponse, error)
+}
+
+// What protoc would have generated from
+//
+//	service Cache {
+//	  rpc Get(Request) returns (Response);
+//	  rpc Remove(Request) returns (Response);
+//	  rpc Set(Request) returns (Response);
+//	  rpc GetMulti(BatchRequest) returns (BatchResponse);
+//	}
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: "qecache.Cache",
+	HandlerType: (*cacheService)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Get", Handler: handler(cacheService.get, methodGet)},
+		{MethodName: "Remove", Handler: handler(cacheService.remove, methodRemove)},
+		{MethodName: "Set", Handler: handler(cacheService.set, methodSet)},
+		{MethodName: "GetMulti", Handler: handler(cacheService.getMulti, methodGetMulti)},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// Adapt a method of the service to the handler signature of gRPC.
+// Req and Res are wire messages, the codec checks it when it is called
+func handler[Req, Res any](
+	method func(cacheService, context.Context, *Req) (*Res, error),
+	fullMethod string,
+) func(any, context.Context, func(any) error, grpc.UnaryServerInterceptor) (any, error) {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		req := new(Req)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return method(srv.(cacheService), ctx, req)
+		}
+		info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+		return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+			return method(srv.(cacheService), ctx, req.(*Req))
+		})
+	}
+}
+
+// find the controller, or explain what is wrong with the request
+func (s *Server) controllerOf(req *wire.Request) (*qecache.Controller, error) {
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "key is required")
+	}
+	controller := qecache.GetController(req.Namespace)
+	if controller == nil {
+		return nil, status.Error(codes.NotFound, "No such controller "+req.Namespace)
+	}
+	return controller, nil
+}
+
+// Query an cache entry by key, like a GET of qecache.HTTPServer
+func (s *Server) get(ctx context.Context, req *wire.Request) (*wire.Response, error) {
+	s.logger.Debug("request", "server", s.selfAddr, "method", "Get", "controller", req.Namespace, "key", req.Key)
+	controller, err := s.controllerOf(req)
+	if err != nil {
+		return nil, err
+	}
+	return qecache.ResponseOfView(controller.GetContext(ctx, req.Key)), nil
+}
+
+// Drop an entry from the local cache, like a DELETE with SCOPE_LOCAL
+func (s *Server) remove(ctx context.Context, req *wire.Request) (*wire.Response, error) {
+	s.logger.Debug("request", "server", s.selfAddr, "method", "Remove", "controller", req.Namespace, "key", req.Key)
+	controller, err := s.controllerOf(req)
+	if err != nil {
+		return nil, err
+	}
+	controller.RemoveLocally(req.Key)
+	return &wire.Response{Status: wire.StatusOK}, nil
+}
+
+// Store an entry in the local cache, like a PUT with SCOPE_LOCAL
+func (s *Server) set(ctx context.Context, req *wire.Request) (*wire.Response, error) {
+	s.logger.Debug("request", "server", s.selfAddr, "method", "Set", "controller", req.Namespace, "key", req.Key)
+	controller, err := s.controllerOf(req)
+	if err != nil {
+		return nil, err
+	}
+	var expire time.Time
+	if req.Expire != 0 {
+		expire = time.Unix(0, req.Expire)
+	}
+	controller.SetLocally(req.Key, qecache.NewByteView(req.Value, expire))
+	return &wire.Response{Status: wire.StatusOK}, nil
+}
+
+// Query many entries at once, like a POST of qecache.HTTPServer
+func (s *Server) getMulti(ctx context.Context, req *wire.BatchRequest) (*wire.BatchResponse, error) {
+	s.logger.Debug("request", "server", s.selfAddr, "method", "GetMulti", "controller", req.Namespace, "keys", len(req.Keys))
+	controller := qecache.GetController(req.Namespace)
+	if controller == nil {
+		return nil, status.Error(codes.NotFound, "No such controller "+req.Namespace)
+	}
+	return qecache.BatchOfResults(req.Keys, controller.GetMultiResults(ctx, req.Keys)), nil
+}
+
+// Set the peers for a server.
+// caveat: it removes old peers that are not listed, and closes their
+// connections. The peers in both lists keep theirs, with the calls in flight
+// Parameters:
+// - peerAddrs: pass arbitrary peer's addresses
+func (s *Server) SetPeers(peerAddrs ...string) error {
+	s.mu.Lock()
+	wanted := make(map[string]bool, len(peerAddrs))
+	for _, addr := range peerAddrs {
+		wanted[addr] = true
+	}
+
+	// dial the new peers first, so that nothing changes if one fails.
+	// NewClient does not connect yet, it connects on the first call
+	added := make(map[string]*client)
+	for _, addr := range peerAddrs {
+		if _, ok := s.clients[addr]; ok || added[addr] != nil || addr == s.selfAddr {
+			continue
+		}
+		conn, err := grpc.NewClient(addr, s.dialOptions...)
+		if err != nil {
+			s.mu.Unlock()
+			for _, c := range added {
+				c.conn.Close()
+			}
+			return err
+		}
+		added[addr] = &client{addr: addr, conn: conn, timeout: s.timeout}
+	}
+
+	// only touch what changed, like qecache.HTTPServer.SetPeers
+	clients := make(map[string]*client, len(peerAddrs))
+	var gone []string
+	var closing []*client
+	for addr, c := range s.clients {
+		if wanted[addr] {
+			clients[addr] = c
+			continue
+		}
+		gone = append(gone, addr)
+		closing = append(closing, c)
+	}
+	if !wanted[s.selfAddr] {
+		gone = append(gone, s.selfAddr)
+	}
+	for addr, c := range added {
+		clients[addr] = c
+	}
+	s.peers.Remove(gone...)
+	s.peers.Add(peerAddrs...)
+	s.clients = clients
+	s.mu.Unlock()
+
+	// nobody picks the removed peers any more
+	for _, c := range closing {
+		c.conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) PeerOfKey(key string) (qecache.RemotePeer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer := s.peers.Get(key); peer != "" && peer != s.selfAddr {
+		s.logger.Debug("pick peer", "server", s.selfAddr, "key", key, "peer", peer)
+		return s.clients[peer], true
+	}
+	return nil, false
+}
+
+func (s *Server) AllPeers() []qecache.RemotePeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]qecache.RemotePeer, 0, len(s.clients))
+	for _, client := range s.clients {
+		peers = append(peers, client)
+	}
+	return peers
+}
+
+var _ qecache.PeerDict = (*Server)(nil)
+var _ qecache.PeerLister = (*Server)(nil)
@@ -0,0 +1,181 @@
+package grpctransport
+
+import (
+	"QECache"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Start a node listening in memory, returns the dial options to reach it
+func startBufconnNode(t *testing.T, addr string, opts ...grpc.ServerOption) (*Server, []grpc.DialOption) {
+	lis := bufconn.Listen(1 << 20)
+	dialOptions := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+
+	node := NewServer(ServerConfig{SelfAddr: addr, DialOptions: dialOptions})
+	server := grpc.NewServer(opts...)
+	node.Register(server)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return node, dialOptions
+}
+
+func TestGRPC(t *testing.T) {
+	loads := 0
+	gee := qecache.NewController("grpc", 2<<10, qecache.TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		if key == "unknown" {
+			return nil, 0, fmt.Errorf("%s not exist", key)
+		}
+		loads++
+		return []byte("630"), time.Hour, nil
+	}))
+	t.Cleanup(gee.Close)
+
+	_, dialOptions := startBufconnNode(t, "passthrough:///remote")
+
+	// the node asking the remote one. Dial options only reach the remote
+	local := NewServer(ServerConfig{SelfAddr: "passthrough:///local", DialOptions: dialOptions})
+	if err := local.SetPeers("passthrough:///remote"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, ok := local.PeerOfKey("Tom")
+	if !ok {
+		t.Fatalf("the only peer should own every key")
+	}
+	peer := found.(*client)
+
+	view, err := peer.Lookup(context.Background(), "grpc", "Tom")
+	if err != nil || view.String() != "630" || view.Expire().IsZero() {
+		t.Fatalf("unexpected lookup result %s, %v", view, err)
+	}
+
+	if _, err := peer.Lookup(context.Background(), "grpc", "unknown"); err == nil {
+		t.Fatalf("errors of the fetcher should reach the client")
+	}
+	if _, err := peer.Lookup(context.Background(), "no-such-controller", "Tom"); err == nil {
+		t.Fatalf("unknown controller should be an error")
+	}
+
+	if err := peer.Remove("grpc", "Tom"); err != nil {
+		t.Fatal(err)
+	}
+	gee.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("remove over gRPC should invalidate the key, loads %d", loads)
+	}
+
+	expire := time.Now().Add(time.Minute)
+	if err := peer.Set("grpc", "Sam", qecache.NewByteView([]byte("567"), expire)); err != nil {
+		t.Fatal(err)
+	}
+	if view, _ := gee.Get("Sam"); view.String() != "567" || !view.Expire().Equal(expire) || loads != 2 {
+		t.Fatalf("set over gRPC should store the key, got %s", view)
+	}
+
+	results, err := peer.LookupMulti(context.Background(), "grpc", []string{"Sam", "unknown"})
+	if err != nil || len(results) != 2 || results[0].Value.String() != "567" || results[1].Err == nil {
+		t.Fatalf("unexpected batch result %v, %v", results, err)
+	}
+
+	if peers := local.AllPeers(); len(peers) != 1 {
+		t.Fatalf("expect one peer, got %d", len(peers))
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// a peer that never answers
+	hang := make(chan struct{})
+	t.Cleanup(func() { close(hang) })
+	_, dialOptions := startBufconnNode(t, "passthrough:///hung",
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			select {
+			case <-hang:
+			case <-ctx.Done():
+			}
+			return nil, ctx.Err()
+		}))
+
+	local := NewServer(ServerConfig{SelfAddr: "passthrough:///local", DialOptions: dialOptions, Timeout: 50 * time.Millisecond})
+	if err := local.SetPeers("passthrough:///hung"); err != nil {
+		t.Fatal(err)
+	}
+	found, _ := local.PeerOfKey("Tom")
+	peer := found.(*client)
+
+	// Remove and Set have no context, the timeout stops them
+	start := time.Now()
+	err := peer.Remove("grpc", "Tom")
+	if status.Code(err) != codes.DeadlineExceeded || time.Since(start) > time.Second {
+		t.Fatalf("expect a timeout, got %v after %v", err, time.Since(start))
+	}
+	if err := peer.Set("grpc", "Tom", qecache.NewByteView([]byte("630"), time.Time{})); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expect a timeout, got %v", err)
+	}
+}
+
+func TestBatchUnsupported(t *testing.T) {
+	// a server that knows none of the methods, like one that predates
+	// the batch lookups does not know that one
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	local := NewServer(ServerConfig{SelfAddr: "passthrough:///local", DialOptions: []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}})
+	if err := local.SetPeers("passthrough:///old"); err != nil {
+		t.Fatal(err)
+	}
+	found, _ := local.PeerOfKey("Tom")
+	if _, err := found.(*client).LookupMulti(context.Background(), "grpc", []string{"Tom"}); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expect the batch to be unsupported, got %v", err)
+	}
+}
+
+func TestSetPeersKeepsConnections(t *testing.T) {
+	local := NewServer(ServerConfig{SelfAddr: "passthrough:///local", DialOptions: []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}})
+	if err := local.SetPeers("passthrough:///local", "passthrough:///a", "passthrough:///b"); err != nil {
+		t.Fatal(err)
+	}
+	a, b := local.clients["passthrough:///a"], local.clients["passthrough:///b"]
+
+	if err := local.SetPeers("passthrough:///local", "passthrough:///a", "passthrough:///c"); err != nil {
+		t.Fatal(err)
+	}
+	if local.clients["passthrough:///a"] != a || a.conn.GetState() == connectivity.Shutdown {
+		t.Fatalf("a peer that stays should keep its connection")
+	}
+	if _, ok := local.clients["passthrough:///b"]; ok || b.conn.GetState() != connectivity.Shutdown {
+		t.Fatalf("a removed peer should be closed")
+	}
+	if peers := local.AllPeers(); len(peers) != 2 {
+		t.Fatalf("expect two peers, got %d", len(peers))
+	}
+	for i := 0; i < 100; i++ {
+		if peer, ok := local.PeerOfKey(fmt.Sprint(i)); ok && peer.(*client).addr == "passthrough:///b" {
+			t.Fatalf("a removed peer should own no key")
+		}
+	}
+}
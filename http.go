@@ -4,13 +4,20 @@ package qecache
 
 import (
 	"QECache/consistenthash"
+	"QECache/wire"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // ======================================
@@ -21,34 +28,314 @@ import (
 
 type httpClient struct {
 	baseURL string
+	// latency of the requests to this peer, exposed as metrics
+	latency *histogram
+	// the configured client, http.DefaultClient when nil
+	client *http.Client
+	// how many more attempts after the first one fails
+	maxRetries int
+	// the base of the exponential backoff between attempts
+	retryBackoff time.Duration
+	// tracks the health of the peer. Optional
+	breaker *circuitBreaker
+	// told about the requests in flight, for placements that balance
+	// them. Optional
+	tracker consistenthash.LoadTracker
+	// the url of the peer, as known by the placement
+	peer string
+}
+
+// Send a request, retrying on failures that are likely to be transient.
+// Only use it for idempotent requests: a request that failed may still
+// have been processed by the peer.
+func (c *httpClient) do(ctx context.Context, method string, requestURL string, header http.Header, body []byte) (*http.Response, error) {
+	client := c.client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.tracker != nil {
+		c.tracker.Inc(c.peer)
+		defer c.tracker.Done(c.peer)
+	}
+
+	for attempt := 0; ; attempt++ {
+		// a request can't be sent twice, build a new one each time
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		start := time.Now()
+		res, err := client.Do(req)
+		if c.latency != nil {
+			c.latency.observe(time.Since(start))
+		}
+
+		if !retryable(ctx, res, err) || attempt >= c.maxRetries {
+			c.recordHealth(ctx, res, err)
+			return res, err
+		}
+		if res != nil {
+			// drain the body so that the connection can be reused
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		if err := sleepBackoff(ctx, c.retryBackoff, attempt); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Tell the breaker whether the peer answered.
+// An error of the fetcher on the peer side is still an answer, while
+// the caller giving up says nothing about the peer
+func (c *httpClient) recordHealth(ctx context.Context, res *http.Response, err error) {
+	if c.breaker == nil || ctx.Err() != nil {
+		return
+	}
+	c.breaker.record(!retryable(ctx, res, err))
+}
+
+// Whether another attempt might succeed.
+// The caller giving up is final, so are answers of the peer except
+// those telling it is temporarily unable to answer
+func retryable(ctx context.Context, res *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Wait a random duration in [0, base * 2^attempt), the "full jitter"
+// backoff. Randomness spreads the retries of many nodes over time, so
+// that a recovering peer is not hit by all of them at once.
+func sleepBackoff(ctx context.Context, base time.Duration, attempt int) error {
+	if base <= 0 {
+		return nil
+	}
+	// cap the exponent so that the shift can't overflow
+	ceiling := base << min(attempt, 16)
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(ceiling))))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 func (c *httpClient) Get(cname string, key string) ([]byte, error) {
+	return c.GetContext(context.Background(), cname, key)
+}
+
+func (c *httpClient) GetContext(ctx context.Context, cname string, key string) ([]byte, error) {
+	view, err := c.Lookup(ctx, cname, key)
+	if err != nil {
+		return nil, err
+	}
+	// the bytes were just read from the network, nobody else has them
+	return view.value, nil
+}
+
+// Lookups skip a peer whose circuit is open, the caller tries the next
+// one. Writes and invalidations don't: every owner must get them
+func (c *httpClient) allow() error {
+	if c.breaker != nil && !c.breaker.allow() {
+		return fmt.Errorf("%v: %w", c.peer, errCircuitOpen)
+	}
+	return nil
+}
+
+func (c *httpClient) Lookup(ctx context.Context, cname string, key string) (ByteView, error) {
+	if err := c.allow(); err != nil {
+		return ByteView{}, err
+	}
 	requestURL := fmt.Sprintf("%v%v/%v",
 		c.baseURL,
 		url.QueryEscape(cname),
 		url.QueryEscape(key),
 	)
 
-	res, error := http.Get(requestURL)
+	// ask for the binary envelope, but an old peer may only know raw bytes
+	header := http.Header{"Accept": {wire.CONTENT_TYPE + ", application/octet-stream"}}
+	if isFallback(ctx) {
+		header.Set(FALLBACK_HEADER, "1")
+	}
 
+	res, error := c.do(ctx, http.MethodGet, requestURL, header, nil)
 	if error != nil {
-		return nil, error
+		return ByteView{}, error
 	}
 
 	defer res.Body.Close() // remember to always close request body stream
 
+	bytes, error := io.ReadAll(res.Body)
+
+	if error != nil {
+		return ByteView{}, fmt.Errorf("error when reading stream: %v", error)
+	}
+
+	if res.Header.Get("Content-Type") == wire.CONTENT_TYPE {
+		var msg wire.Response
+		if err := msg.UnmarshalBinary(bytes); err != nil {
+			return ByteView{}, fmt.Errorf("bad response: %v", err)
+		}
+		return ViewOfResponse(&msg)
+	}
+
+	// a peer without the envelope still tells a missing key by its status,
+	// so that the miss is final here as well
+	if res.StatusCode == http.StatusNotFound {
+		msg := strings.TrimSpace(string(bytes))
+		if msg == "" {
+			msg = res.Status
+		}
+		return ByteView{}, &remoteError{msg: msg, sentinel: ErrNotFound}
+	}
+	if res.StatusCode != http.StatusOK {
+		return ByteView{}, fmt.Errorf("API error: %v", res.Status)
+	}
+
+	return ByteView{value: bytes}, nil
+}
+
+func (c *httpClient) Remove(cname string, key string) error {
+	requestURL := fmt.Sprintf("%v%v/%v?scope=%v",
+		c.baseURL,
+		url.QueryEscape(cname),
+		url.QueryEscape(key),
+		SCOPE_LOCAL,
+	)
+
+	// removing twice is harmless, so it can be retried as well
+	res, err := c.do(context.Background(), http.MethodDelete, requestURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("API error: %v", res.Status)
+	}
+	return nil
+}
+
+func (c *httpClient) Set(cname string, key string, value ByteView) error {
+	requestURL := fmt.Sprintf("%v%v/%v?scope=%v",
+		c.baseURL,
+		url.QueryEscape(cname),
+		url.QueryEscape(key),
+		SCOPE_LOCAL,
+	)
+
+	// the envelope carries the expiration along with the value
+	msg := wire.Request{Namespace: cname, Key: key, Value: value.value}
+	if !value.expire.IsZero() {
+		msg.Expire = value.expire.UnixNano()
+	}
+	body, _ := msg.MarshalBinary()
+	header := http.Header{"Content-Type": {wire.CONTENT_TYPE}}
+
+	// storing twice is harmless, so it can be retried as well
+	res, err := c.do(context.Background(), http.MethodPut, requestURL, header, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("API error: %v", res.Status)
+	}
+	return nil
+}
+
+func (c *httpClient) LookupMulti(ctx context.Context, cname string, keys []string) ([]LookupResult, error) {
+	// a server takes up to MAX_BATCH_KEYS keys per request
+	results := make([]LookupResult, 0, len(keys))
+	for start := 0; start < len(keys); start += MAX_BATCH_KEYS {
+		batch, err := c.lookupBatch(ctx, cname, keys[start:min(start+MAX_BATCH_KEYS, len(keys))])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+func (c *httpClient) lookupBatch(ctx context.Context, cname string, keys []string) ([]LookupResult, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+	requestURL := fmt.Sprintf("%v%v", c.baseURL, url.QueryEscape(cname))
+
+	msg := wire.BatchRequest{Namespace: cname, Keys: keys}
+	body, _ := msg.MarshalBinary()
+	// unlike single lookups there is no raw fallback. A peer without the
+	// batch endpoint rejects the POST, the keys are then asked one by one
+	header := http.Header{
+		"Content-Type": {wire.CONTENT_TYPE},
+		"Accept":       {wire.CONTENT_TYPE},
+	}
+	if isFallback(ctx) {
+		header.Set(FALLBACK_HEADER, "1")
+	}
+
+	// a lookup changes nothing, it can be retried despite the POST
+	res, err := c.do(ctx, http.MethodPost, requestURL, header, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	bytes, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error when reading stream: %v", err)
+	}
+	if batchUnsupported(res.StatusCode) {
+		return nil, fmt.Errorf("%v cannot look up keys in batch, %v: %w", c, res.Status, errors.ErrUnsupported)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != wire.CONTENT_TYPE {
 		return nil, fmt.Errorf("API error: %v", res.Status)
 	}
 
-	bytes, error := io.ReadAll(res.Body)
+	var answer wire.BatchResponse
+	if err := answer.UnmarshalBinary(bytes); err != nil {
+		return nil, fmt.Errorf("bad response: %v", err)
+	}
+	return ResultsOfBatch(keys, &answer)
+}
 
-	if error != nil {
-		return nil, fmt.Errorf("error when reading stream: %v", error)
+// How a peer that predates the batch endpoint answers a batch.
+// The baseline server takes the POST for a GET without key and answers
+// 400, other servers may refuse the method or the envelope
+func batchUnsupported(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType:
+		return true
 	}
+	return false
+}
 
-	return bytes, nil
+// the peer shows up as its address in logs
+func (c *httpClient) String() string {
+	return c.baseURL
 }
 
 // assert httpClient implements RemotePeer (force type check)
@@ -58,6 +345,11 @@ func (c *httpClient) Get(cname string, key string) ([]byte, error) {
 // we only needs the compiler to carry out type checker, without using
 // the variable _
 var _ RemotePeer = (*httpClient)(nil)
+var _ RemotePeerContext = (*httpClient)(nil)
+var _ LookupPeer = (*httpClient)(nil)
+var _ RemovablePeer = (*httpClient)(nil)
+var _ WritablePeer = (*httpClient)(nil)
+var _ BatchPeer = (*httpClient)(nil)
 
 // ======================================
 // HTTP Server
@@ -70,6 +362,48 @@ var _ RemotePeer = (*httpClient)(nil)
 // I prefer to name constants with all capital letters
 const DEFAULT_BASE_PATH = "/_cacheserver/"
 
+// Where Prometheus scrapes the metrics. It is outside of the base path
+const DEFAULT_METRICS_PATH = "/metrics"
+
+// Where admins can check the health of peers. It is outside of the base path
+const DEFAULT_ADMIN_PATH = "/_admin/peers"
+
+// Defaults of the requests sent to peers
+const (
+	// a single attempt, retries get their own
+	DEFAULT_PEER_TIMEOUT = 5 * time.Second
+	DEFAULT_MAX_RETRIES  = 2
+	// the first retry waits up to this long, then it doubles
+	DEFAULT_RETRY_BACKOFF = 50 * time.Millisecond
+	// idle keep-alive connections kept for each peer
+	DEFAULT_MAX_IDLE_CONNS_PER_HOST = 16
+	DEFAULT_IDLE_CONN_TIMEOUT       = 90 * time.Second
+)
+
+// Limits of a batch lookup, POST /<basepath>/<controller>, so that a
+// client can't make a node buffer or load without bound.
+// Clients split larger batches, see httpClient.LookupMulti
+const (
+	MAX_BATCH_KEYS = 1000
+	// room for MAX_BATCH_KEYS keys of a few KB each
+	MAX_BATCH_BYTES = 4 << 20
+)
+
+// Set on a lookup sent to the stand-in of the owners of a key, see
+// FallbackPeerDict. The receiving node loads the key itself
+const FALLBACK_HEADER = "X-Qecache-Fallback"
+
+// Scopes of an invalidation or a write, given as the `scope` query
+// parameter of DELETE and PUT /<basepath>/<controller>/<key>
+const (
+	// only the node receiving the request. Used between peers
+	SCOPE_LOCAL = "local"
+	// the receiving node and the owner of the key. The default
+	SCOPE_OWNER = "owner"
+	// every node of the cluster. Only for DELETE
+	SCOPE_ALL = "all"
+)
+
 type HTTPServer struct {
 	// selfIP ip address
 	// e.g. https://excitedspider.github.io
@@ -78,10 +412,33 @@ type HTTPServer struct {
 	basePath string
 	mu       sync.Mutex
 	// peer information, used to get entry from peer if cache missed
-	peers consistenthash.KeyHashInfo
+	peers consistenthash.Placement
 	// each url has a client.
 	// which might not be so efficient but we do it anyway because it's safe
 	httpClients map[string]*httpClient
+	// the path of the metrics endpoint
+	metricsPath string
+	// latency histograms of each peer.
+	// They survive SetPeers so that counters never go backwards
+	peerLatency map[string]*histogram
+	// where to write logs
+	logger Logger
+	// the settings of the requests sent to peers
+	peerTimeout  time.Duration
+	maxRetries   int
+	retryBackoff time.Duration
+	// shared by the clients of every peer, it pools their connections
+	transport http.RoundTripper
+	// the path of the peer health endpoint
+	adminPath string
+	// circuit breakers of each peer, they survive SetPeers like peerLatency
+	breakers         map[string]*circuitBreaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// how many more keys a peer takes than others, 1 when absent
+	peerWeights map[string]int
+	// how many nodes own each key
+	replicas int
 }
 
 type HTTPServerConfig struct {
@@ -89,6 +446,49 @@ type HTTPServerConfig struct {
 	SelfIP string
 	// optional
 	BasePath string
+	// optional, DEFAULT_METRICS_PATH by default
+	MetricsPath string
+	// optional, slog.Default() by default.
+	// Every request is logged at Debug level
+	Logger Logger
+	// optional, how long a single attempt to reach a peer may take.
+	// DEFAULT_PEER_TIMEOUT by default, negative for no timeout
+	PeerTimeout time.Duration
+	// optional, how many times a failed request to a peer is retried.
+	// DEFAULT_MAX_RETRIES by default, negative for no retry
+	MaxRetries int
+	// optional, DEFAULT_RETRY_BACKOFF by default
+	RetryBackoff time.Duration
+	// optional, DEFAULT_MAX_IDLE_CONNS_PER_HOST by default
+	MaxIdleConnsPerHost int
+	// optional, DEFAULT_IDLE_CONN_TIMEOUT by default
+	IdleConnTimeout time.Duration
+	// optional, replaces the pooled transport built from the two
+	// settings above. Useful for TLS or testing
+	Transport http.RoundTripper
+	// optional, DEFAULT_ADMIN_PATH by default
+	AdminPath string
+	// optional, consecutive failures before a peer is skipped.
+	// DEFAULT_BREAKER_THRESHOLD by default
+	BreakerThreshold int
+	// optional, how long a failing peer is skipped before a probe.
+	// DEFAULT_BREAKER_COOLDOWN by default
+	BreakerCooldown time.Duration
+	// optional, the weight of peers by url, the current node included.
+	// A peer of weight 8 takes about 8 times the keys of a peer of
+	// weight 1, e.g. give the memory of each machine in GB.
+	// Peers that are not listed have weight 1.
+	// SetWeightedPeers and AddWeightedPeer change them later
+	PeerWeights map[string]int
+	// optional, how keys are spread over peers. A consistent hash ring
+	// with DEFAULT_VNODE_SCALAR vnodes per peer by default.
+	// Each server needs its own, and every node of the cluster must use
+	// the same algorithm for them to agree on owners
+	Placement consistenthash.Placement
+	// optional, how many nodes own each key, 1 by default.
+	// When the primary owner of a key can't be reached, the next ones
+	// are asked in turn. The Placement must be a ReplicatedPlacement
+	Replicas int
 }
 
 func NewHTTPServer(config HTTPServerConfig) *HTTPServer {
@@ -98,18 +498,88 @@ func NewHTTPServer(config HTTPServerConfig) *HTTPServer {
 	if config.BasePath == "" {
 		config.BasePath = DEFAULT_BASE_PATH
 	}
+	if config.MetricsPath == "" {
+		config.MetricsPath = DEFAULT_METRICS_PATH
+	}
+	if config.Logger == nil {
+		config.Logger = defaultLogger()
+	}
+	if config.PeerTimeout == 0 {
+		config.PeerTimeout = DEFAULT_PEER_TIMEOUT
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DEFAULT_MAX_RETRIES
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = DEFAULT_MAX_IDLE_CONNS_PER_HOST
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = DEFAULT_IDLE_CONN_TIMEOUT
+	}
+	if config.AdminPath == "" {
+		config.AdminPath = DEFAULT_ADMIN_PATH
+	}
+	if config.BreakerThreshold == 0 {
+		config.BreakerThreshold = DEFAULT_BREAKER_THRESHOLD
+	}
+	if config.BreakerCooldown == 0 {
+		config.BreakerCooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	if config.Transport == nil {
+		// start from the default transport to keep its proxy and dial settings
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+		transport.IdleConnTimeout = config.IdleConnTimeout
+		config.Transport = transport
+	}
+	if config.Placement == nil {
+		config.Placement = consistenthash.New(DEFAULT_VNODE_SCALAR, nil)
+	}
+	if config.Replicas == 0 {
+		config.Replicas = 1
+	}
+	if _, ok := config.Placement.(consistenthash.ReplicatedPlacement); !ok && config.Replicas > 1 {
+		panic("Placement does not support Replicas")
+	}
+
+	// a copy, the weights change with SetWeightedPeers
+	peerWeights := make(map[string]int, len(config.PeerWeights))
+	for peerUrl, weight := range config.PeerWeights {
+		peerWeights[peerUrl] = weight
+	}
 
 	return &HTTPServer{
-		selfIP:   config.SelfIP,
-		basePath: config.BasePath,
+		selfIP:      config.SelfIP,
+		basePath:    config.BasePath,
+		peers:       config.Placement,
+		httpClients: make(map[string]*httpClient),
+		metricsPath: config.MetricsPath,
+		peerLatency: make(map[string]*histogram),
+		logger:      config.Logger,
+		// negative values mean "none"
+		peerTimeout:      max(config.PeerTimeout, 0),
+		maxRetries:       max(config.MaxRetries, 0),
+		retryBackoff:     config.RetryBackoff,
+		transport:        config.Transport,
+		adminPath:        config.AdminPath,
+		breakers:         make(map[string]*circuitBreaker),
+		breakerThreshold: config.BreakerThreshold,
+		breakerCooldown:  config.BreakerCooldown,
+		peerWeights:      peerWeights,
+		replicas:         config.Replicas,
 	}
 }
 
+// Write a printf-style message to the logger at Debug level.
+// Kept for compatibility, the server itself logs structured records.
 func (p *HTTPServer) Log(format string, v ...interface{}) {
 	// interface{} means any type
 
 	// the spread operator ... is suffix, weird syntax
-	log.Printf("[Server %s %s]: %s", p.basePath, p.selfIP, fmt.Sprintf(format, v...))
+	p.logger.Debug(fmt.Sprintf(format, v...), "server", p.selfIP, "basePath", p.basePath)
 }
 
 func (p *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -118,67 +588,431 @@ func (p *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("Empty Request")
 	}
 
+	if r.URL.Path == p.metricsPath {
+		p.handleMetrics(w, r)
+		return
+	}
+	if r.URL.Path == p.adminPath {
+		p.handlePeerHealth(w, r)
+		return
+	}
+
 	// TODO: consider allow more than one servers
 	// try dispatch to correct ones
 	if !strings.HasPrefix(r.URL.Path, p.basePath) {
 		http.NotFound(w, r)
-		p.Log("User tries to access unknown service: %s", r.URL.Path)
+		p.logger.Debug("unknown service", "server", p.selfIP, "path", r.URL.Path)
 		return
 	}
 
-	p.Log("%s %s", r.Method, r.URL.Path)
+	p.logger.Debug("request", "server", p.selfIP, "method", r.Method, "path", r.URL.Path)
 
-	// as there is only one defined API, we can do this without parsing the API
-	// need to extend it in the future
-	p.handleQueryCache(w, r)
+	// all the APIs share the same path, the method tells them apart
+	switch r.Method {
+	case http.MethodGet:
+		p.handleQueryCache(w, r)
+	case http.MethodDelete:
+		p.handleRemove(w, r)
+	case http.MethodPut:
+		p.handleSet(w, r)
+	case http.MethodPost:
+		p.handleQueryBatch(w, r)
+	default:
+		w.Header().Set("Allow", "GET, DELETE, PUT, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
-// Query an cache entry by key
-// GET /<basepath>/<controller>/<key>
-func (p *HTTPServer) handleQueryCache(w http.ResponseWriter, r *http.Request) {
+// Split /<basepath>/<controller>/<key> and find the controller.
+// It writes the error response itself, so callers only need to return
+// when ok is false
+func (p *HTTPServer) parseCachePath(w http.ResponseWriter, r *http.Request) (controller *Controller, key string, ok bool) {
 	parts := strings.SplitN(r.URL.Path[len(p.basePath):], "/", 2)
 	if len(parts) != 2 {
 		http.Error(w, "bad request", http.StatusBadRequest)
-		return
+		return nil, "", false
 	}
 
 	cName := parts[0]
-	key := parts[1]
+	key = parts[1]
 
-	controller := GetController(cName)
+	controller = GetController(cName)
 	if controller == nil {
 		http.Error(w, "No such controller "+cName, http.StatusNotFound)
+		return nil, "", false
+	}
+	return controller, key, true
+}
+
+// Query an cache entry by key
+// GET /<basepath>/<controller>/<key>
+func (p *HTTPServer) handleQueryCache(w http.ResponseWriter, r *http.Request) {
+	controller, key, ok := p.parseCachePath(w, r)
+	if !ok {
+		return
+	}
+
+	// the request context is cancelled when the peer hangs up,
+	// so there is no point to keep loading for it
+	ctx := r.Context()
+	if r.Header.Get(FALLBACK_HEADER) != "" {
+		ctx = withFallback(ctx)
+	}
+	view, err := controller.GetContext(ctx, key)
+
+	// peers that know the envelope also learn the expiration
+	if acceptsWire(r) {
+		msg := ResponseOfView(view, err)
+		body, _ := msg.MarshalBinary()
+		w.Header().Set("Content-Type", wire.CONTENT_TYPE)
+		if err != nil {
+			w.WriteHeader(statusOfError(err))
+		}
+		w.Write(body)
 		return
 	}
 
-	view, err := controller.Get(key)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), statusOfError(err))
 		return
 	}
 
-	// TODO: support more content type than plain byte string
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Write(view.ByteSlice())
 }
 
+// Query many cache entries at once, see Controller.GetMulti.
+// It only speaks the envelope: the body is a wire.BatchRequest, and the
+// answer a wire.BatchResponse with a status for each key.
+// Up to MAX_BATCH_KEYS keys and MAX_BATCH_BYTES bytes, 413 otherwise
+// POST /<basepath>/<controller>
+func (p *HTTPServer) handleQueryBatch(w http.ResponseWriter, r *http.Request) {
+	cName := r.URL.Path[len(p.basePath):]
+	controller := GetController(cName)
+	if controller == nil {
+		http.Error(w, "No such controller "+cName, http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BATCH_BYTES))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "batch too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+	var msg wire.BatchRequest
+	if err := msg.UnmarshalBinary(body); err != nil {
+		http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(msg.Keys) > MAX_BATCH_KEYS {
+		http.Error(w, fmt.Sprintf("more than %d keys", MAX_BATCH_KEYS), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ctx := r.Context()
+	if r.Header.Get(FALLBACK_HEADER) != "" {
+		ctx = withFallback(ctx)
+	}
+	answer := BatchOfResults(msg.Keys, controller.GetMultiResults(ctx, msg.Keys))
+	body, _ = answer.MarshalBinary()
+	w.Header().Set("Content-Type", wire.CONTENT_TYPE)
+	w.Write(body)
+}
+
+// 404 when the key does not exist, 429 when the load was shed,
+// 500 for any other failure.
+// Unlike 503, 429 is neither retried nor counted against the peer by
+// its circuit breaker: retrying is what the busy peer wants to avoid
+func statusOfError(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrLoadShed):
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// whether the client asked for the binary envelope
+func acceptsWire(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			// drop parameters such as q=0.9
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.TrimSpace(mediaType) == wire.CONTENT_TYPE {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Metrics of every controller and peer, in Prometheus text format
+// GET /metrics
+func (p *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	peerLatency := make(map[string]*histogram, len(p.peerLatency))
+	for peer, h := range p.peerLatency {
+		peerLatency[peer] = h
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, peerLatency)
+}
+
+// The circuit breaker state of every peer, as JSON
+// GET /_admin/peers
+func (p *HTTPServer) handlePeerHealth(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	peers := make([]PeerHealth, 0, len(p.breakers))
+	for peer, breaker := range p.breakers {
+		peers = append(peers, breaker.health(peer))
+	}
+	p.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Peer < peers[j].Peer
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+// Invalidate a cache entry by key
+// DELETE /<basepath>/<controller>/<key>?scope=<local|owner|all>
+func (p *HTTPServer) handleRemove(w http.ResponseWriter, r *http.Request) {
+	controller, key, ok := p.parseCachePath(w, r)
+	if !ok {
+		return
+	}
+
+	var err error
+	switch scope := r.URL.Query().Get("scope"); scope {
+	case SCOPE_LOCAL:
+		if key == "" {
+			err = fmt.Errorf("key is required")
+			break
+		}
+		controller.RemoveLocally(key)
+	case SCOPE_OWNER, "":
+		err = controller.Remove(key)
+	case SCOPE_ALL:
+		err = controller.RemoveEverywhere(key)
+	default:
+		http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Store a value, the body is either the wire envelope of a Request,
+// which carries the expiration, or the raw value
+// PUT /<basepath>/<controller>/<key>?scope=<local|owner>
+func (p *HTTPServer) handleSet(w http.ResponseWriter, r *http.Request) {
+	controller, key, ok := p.parseCachePath(w, r)
+	if !ok {
+		return
+	}
+	if key == "" {
+		http.Error(w, "key is required", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "cannot read body", http.StatusBadRequest)
+		return
+	}
+
+	var value ByteView
+	// as in Set, a value without expiration gets the default ttl of the
+	// controller, while an envelope without one never expires
+	ttl := time.Duration(0)
+	if r.Header.Get("Content-Type") == wire.CONTENT_TYPE {
+		var msg wire.Request
+		if err := msg.UnmarshalBinary(body); err != nil {
+			http.Error(w, "bad request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		value = ByteView{value: msg.Value}
+		ttl = -1
+		if msg.Expire != 0 {
+			value.expire = time.Unix(0, msg.Expire)
+			// already expired values are dropped by the cache
+			ttl = max(time.Until(value.expire), time.Nanosecond)
+		}
+	} else {
+		value = ByteView{value: body}
+		if controller.ttl > 0 {
+			value.expire = time.Now().Add(controller.ttl)
+		}
+	}
+
+	switch scope := r.URL.Query().Get("scope"); scope {
+	case SCOPE_LOCAL:
+		controller.SetLocally(key, value)
+	case SCOPE_OWNER, "":
+		err = controller.SetWithTTL(key, value.value, ttl)
+	default:
+		http.Error(w, "unknown scope "+scope, http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 const DEFAULT_VNODE_SCALAR = 4.
 
 // Set the peers for a server.
-// caveat: it removes old peer settings
+// caveat: it removes old peers that are not listed
 // Parameters:
 // - peerUrls: pass arbitrary peer's urls
 func (s *HTTPServer) SetPeers(peerUrls ...string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.setPeers(peerUrls)
+}
+
+// A peer and how many more keys it takes than others,
+// like HTTPServerConfig.PeerWeights. A weight below 1 means 1
+type WeightedPeer struct {
+	Addr   string
+	Weight int
+}
+
+// SetPeers with weights. The weights of peers already there are updated.
+// Weights only matter with a consistenthash.WeightedPlacement
+func (s *HTTPServer) SetWeightedPeers(peers ...WeightedPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setPeers(s.setWeights(peers))
+}
+
+// AddPeer with weights. The weights of peers already there are updated
+func (s *HTTPServer) AddWeightedPeer(peers ...WeightedPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addPeers(s.setWeights(peers))
+}
+
+// Remember the weights and re-weigh the peers already in the ring.
+// Returns the urls of the peers. The caller must hold s.mu
+func (s *HTTPServer) setWeights(peers []WeightedPeer) []string {
+	weighted, canWeigh := s.peers.(consistenthash.WeightedPlacement)
+	peerUrls := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		weight := max(peer.Weight, 1)
+		peerUrls = append(peerUrls, peer.Addr)
+		old, ok := s.peerWeights[peer.Addr]
+		s.peerWeights[peer.Addr] = weight
+		if _, inRing := s.httpClients[peer.Addr]; inRing && canWeigh && (!ok || old != weight) {
+			// adding a node again changes its weight
+			weighted.AddWeighted(peer.Addr, weight)
+		}
+	}
+	return peerUrls
+}
+
+// the caller must hold s.mu
+func (s *HTTPServer) setPeers(peerUrls []string) {
+	wanted := make(map[string]bool, len(peerUrls))
+	for _, peerUrl := range peerUrls {
+		wanted[peerUrl] = true
+	}
+
+	// only touch what changed, the peers in both lists keep their client
+	var gone []string
+	for peerUrl := range s.httpClients {
+		if !wanted[peerUrl] {
+			gone = append(gone, peerUrl)
+		}
+	}
+	s.removePeers(gone)
+	s.addPeers(peerUrls)
+}
+
+// Add peers to the ring. Peers that are already there are left alone.
+// Only the keys the new peers take over move
+func (s *HTTPServer) AddPeer(peerUrls ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addPeers(peerUrls)
+}
 
-	s.peers = *consistenthash.New(DEFAULT_VNODE_SCALAR, nil)
-	s.peers.Add(peerUrls...)
+// Remove peers from the ring. Their keys move to the next peers,
+// the other keys stay where they are
+func (s *HTTPServer) RemovePeer(peerUrls ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removePeers(peerUrls)
+}
 
-	// provide the length so that it might be more efficient
-	s.httpClients = make(map[string]*httpClient, len(peerUrls))
+// the caller must hold s.mu
+func (s *HTTPServer) addPeers(peerUrls []string) {
 	for _, peerUrl := range peerUrls {
-		s.httpClients[peerUrl] = &httpClient{baseURL: peerUrl + s.basePath}
+		if _, ok := s.httpClients[peerUrl]; ok {
+			continue
+		}
+
+		client := s.newClient(peerUrl)
+		if peerUrl != s.selfIP {
+			if _, ok := s.peerLatency[peerUrl]; !ok {
+				s.peerLatency[peerUrl] = newHistogram(LATENCY_BUCKETS)
+				s.breakers[peerUrl] = newCircuitBreaker(s.breakerThreshold, s.breakerCooldown)
+			}
+			client.latency = s.peerLatency[peerUrl]
+			client.breaker = s.breakers[peerUrl]
+		}
+		s.httpClients[peerUrl] = client
+
+		weighted, canWeigh := s.peers.(consistenthash.WeightedPlacement)
+		if weight, ok := s.peerWeights[peerUrl]; ok && canWeigh {
+			weighted.AddWeighted(peerUrl, weight)
+		} else {
+			s.peers.Add(peerUrl)
+		}
+	}
+}
+
+// the caller must hold s.mu
+func (s *HTTPServer) removePeers(peerUrls []string) {
+	var removed []string
+	for _, peerUrl := range peerUrls {
+		if _, ok := s.httpClients[peerUrl]; !ok {
+			continue
+		}
+		// the latency and the breaker stay, in case the peer comes back
+		delete(s.httpClients, peerUrl)
+		removed = append(removed, peerUrl)
+	}
+	s.peers.Remove(removed...)
+}
+
+// A client without latency histogram nor breaker,
+// addPeers sets them for the peers that are not self
+func (s *HTTPServer) newClient(peerUrl string) *httpClient {
+	tracker, _ := s.peers.(consistenthash.LoadTracker)
+	return &httpClient{
+		peer:         peerUrl,
+		tracker:      tracker,
+		baseURL:      peerUrl + s.basePath,
+		client:       &http.Client{Transport: s.transport, Timeout: s.peerTimeout},
+		maxRetries:   s.maxRetries,
+		retryBackoff: s.retryBackoff,
 	}
 }
 
@@ -186,10 +1020,114 @@ func (p *HTTPServer) PeerOfKey(key string) (RemotePeer, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if peer := p.peers.Get(key); peer != "" && peer != p.selfIP {
-		p.Log("Pick peer %s", peer)
-		return p.httpClients[peer], true
+		client, ok := p.httpClients[peer]
+		if !ok {
+			// the placement knows a node that was never added as a peer
+			p.logger.Warn("no client for peer", "server", p.selfIP, "key", key, "peer", peer)
+			return nil, false
+		}
+		// an open circuit means the peer is likely down.
+		// Pretend the key is ours so that it is loaded locally at once
+		if client.breaker != nil && !client.breaker.available() {
+			p.logger.Debug("skip unhealthy peer", "server", p.selfIP, "key", key, "peer", peer)
+			return nil, false
+		}
+		p.logger.Debug("pick peer", "server", p.selfIP, "key", key, "peer", peer)
+		return client, true
 	}
 	return nil, false
 }
 
+func (p *HTTPServer) OwnersOfKey(key string) ([]RemotePeer, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	owners := []string{p.peers.Get(key)}
+	if replicated, ok := p.peers.(consistenthash.ReplicatedPlacement); ok && p.replicas > 1 {
+		owners = replicated.GetN(key, p.replicas)
+	}
+
+	peers := make([]RemotePeer, 0, len(owners))
+	self := -1
+	for _, owner := range owners {
+		if owner == "" {
+			continue
+		}
+		if owner == p.selfIP {
+			self = len(peers)
+			continue
+		}
+		client, ok := p.httpClients[owner]
+		if !ok {
+			p.logger.Warn("no client for peer", "server", p.selfIP, "key", key, "peer", owner)
+			continue
+		}
+		// unhealthy owners are listed as well: writes and invalidations
+		// must reach all of them. A lookup skips them when it is sent
+		peers = append(peers, client)
+	}
+	return peers, self
+}
+
+// The node after the owners on the ring stands in for them.
+// Needs a ReplicatedPlacement, there is no fallback otherwise.
+// caveat: the stand-in keeps the value until it expires or is removed,
+// even once the owners are back
+func (p *HTTPServer) FallbackOfKey(key string) (RemotePeer, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	replicated, ok := p.peers.(consistenthash.ReplicatedPlacement)
+	if !ok {
+		return nil, false
+	}
+	nodes := replicated.GetN(key, p.replicas+1)
+	if len(nodes) <= p.replicas {
+		// no node besides the owners
+		return nil, false
+	}
+
+	peer := nodes[p.replicas]
+	if peer == p.selfIP {
+		return nil, false
+	}
+	client, ok := p.httpClients[peer]
+	if !ok {
+		p.logger.Warn("no client for peer", "server", p.selfIP, "key", key, "peer", peer)
+		return nil, false
+	}
+	if client.breaker != nil && !client.breaker.available() {
+		return nil, false
+	}
+	p.logger.Debug("pick fallback peer", "server", p.selfIP, "key", key, "peer", peer)
+	return client, true
+}
+
+func (p *HTTPServer) AllPeers() []RemotePeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	peers := make([]RemotePeer, 0, len(p.httpClients))
+	for peerUrl, client := range p.httpClients {
+		if peerUrl != p.selfIP {
+			peers = append(peers, client)
+		}
+	}
+	return peers
+}
+
+// Count the loads of the current node like the requests to the peers,
+// so that a consistenthash.LoadTracker placement sees them
+func (p *HTTPServer) LocalLoad() func() {
+	tracker, ok := p.peers.(consistenthash.LoadTracker)
+	if !ok {
+		return func() {}
+	}
+	tracker.Inc(p.selfIP)
+	return func() { tracker.Done(p.selfIP) }
+}
+
 var _ PeerDict = (*HTTPServer)(nil)
+var _ PeerLister = (*HTTPServer)(nil)
+var _ ReplicaPeerDict = (*HTTPServer)(nil)
+var _ FallbackPeerDict = (*HTTPServer)(nil)
+var _ LoadTrackingPeerDict = (*HTTPServer)(nil)
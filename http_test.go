@@ -0,0 +1,1233 @@
+package qecache
+
+import (
+	"QECache/consistenthash"
+	"QECache/wire"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a RemotePeer that records what has been asked
+type fakePeer struct {
+	gets    int
+	removed []string
+	set     map[string]ByteView
+	// fail every request
+	down bool
+	// answer that no key exists
+	notFound bool
+	// lookups marked as a fallback
+	fallbacks int
+	// requests for many keys
+	batches int
+}
+
+func (p *fakePeer) Get(namespace string, key string) ([]byte, error) {
+	return p.GetContext(context.Background(), namespace, key)
+}
+
+func (p *fakePeer) GetContext(ctx context.Context, namespace string, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.gets++
+	if isFallback(ctx) {
+		p.fallbacks++
+	}
+	if p.down {
+		return nil, fmt.Errorf("peer is down")
+	}
+	if p.notFound {
+		return nil, &remoteError{msg: key + ": not found", sentinel: ErrNotFound}
+	}
+	return []byte("remote " + key), nil
+}
+
+func (p *fakePeer) Lookup(ctx context.Context, namespace string, key string) (ByteView, error) {
+	bytes, err := p.GetContext(ctx, namespace, key)
+	return ByteView{value: bytes}, err
+}
+
+func (p *fakePeer) LookupMulti(ctx context.Context, namespace string, keys []string) ([]LookupResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p.batches++
+	if p.down {
+		return nil, fmt.Errorf("peer is down")
+	}
+	results := make([]LookupResult, len(keys))
+	for i, key := range keys {
+		results[i].Value, results[i].Err = p.Lookup(ctx, namespace, key)
+	}
+	return results, nil
+}
+
+func (p *fakePeer) Remove(namespace string, key string) error {
+	p.removed = append(p.removed, key)
+	return nil
+}
+
+func (p *fakePeer) Set(namespace string, key string, value ByteView) error {
+	if p.down {
+		return fmt.Errorf("peer is down")
+	}
+	if p.set == nil {
+		p.set = make(map[string]ByteView)
+	}
+	p.set[key] = value
+	return nil
+}
+
+// a RemotePeer written before the optional interfaces, it only knows Get
+type getOnlyPeer struct {
+	gets atomic.Int32
+}
+
+func (p *getOnlyPeer) Get(namespace string, key string) ([]byte, error) {
+	p.gets.Add(1)
+	return []byte("remote " + key), nil
+}
+
+// every key is owned by the one peer
+type getOnlyDict struct {
+	peer RemotePeer
+}
+
+func (d getOnlyDict) PeerOfKey(key string) (RemotePeer, bool) {
+	return d.peer, true
+}
+
+// every key is owned by the one remote peer, except those in local
+type fakePeerDict struct {
+	owner  *fakePeer
+	others []*fakePeer
+	local  map[string]bool
+}
+
+func (d *fakePeerDict) PeerOfKey(key string) (RemotePeer, bool) {
+	if d.local[key] {
+		return nil, false
+	}
+	return d.owner, true
+}
+
+func (d *fakePeerDict) AllPeers() []RemotePeer {
+	peers := []RemotePeer{d.owner}
+	for _, p := range d.others {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// every key is owned by the same replicas, in order
+type fakeReplicaDict struct {
+	owners []*fakePeer
+	self   int
+}
+
+func (d *fakeReplicaDict) PeerOfKey(key string) (RemotePeer, bool) {
+	if d.self == 0 {
+		return nil, false
+	}
+	return d.owners[0], true
+}
+
+func (d *fakeReplicaDict) OwnersOfKey(key string) ([]RemotePeer, int) {
+	peers := make([]RemotePeer, len(d.owners))
+	for i, p := range d.owners {
+		peers[i] = p
+	}
+	return peers, d.self
+}
+
+// a fakePeerDict that also names a fallback
+type fakeFallbackDict struct {
+	fakePeerDict
+	fallback *fakePeer
+}
+
+func (d *fakeFallbackDict) FallbackOfKey(key string) (RemotePeer, bool) {
+	return d.fallback, d.fallback != nil
+}
+
+func TestRemove(t *testing.T) {
+	loads := 0
+	gee := NewController("remove", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	owner, other := &fakePeer{}, &fakePeer{}
+	gee.RegisterPeers(&fakePeerDict{owner: owner, others: []*fakePeer{other}, local: map[string]bool{"Tom": true}})
+
+	gee.Get("Tom")
+	if err := gee.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	gee.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("removed key should be loaded again, loads %d", loads)
+	}
+	if len(owner.removed) != 0 {
+		t.Fatalf("locally owned key should not be sent to peers")
+	}
+
+	if err := gee.Remove("Jack"); err != nil || len(owner.removed) != 1 {
+		t.Fatalf("owner should be asked to remove Jack")
+	}
+	if err := gee.RemoveEverywhere("Jack"); err != nil || len(owner.removed) != 2 || len(other.removed) != 1 {
+		t.Fatalf("every peer should be asked to remove Jack")
+	}
+}
+
+func TestHandleRemove(t *testing.T) {
+	loads := 0
+	gee := NewController("http-remove", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999"})
+
+	gee.Get("Tom")
+
+	req := httptest.NewRequest(http.MethodDelete, DEFAULT_BASE_PATH+"http-remove/Tom?scope=local", nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.Code)
+	}
+
+	gee.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("key should be invalidated over http, loads %d", loads)
+	}
+
+	req = httptest.NewRequest(http.MethodPatch, DEFAULT_BASE_PATH+"http-remove/Tom", nil)
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", res.Code)
+	}
+}
+
+func TestSet(t *testing.T) {
+	loads := 0
+	gee := NewController("set", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithTTL(time.Hour))
+	owner := &fakePeer{}
+	gee.RegisterPeers(&fakePeerDict{owner: owner, local: map[string]bool{"Tom": true}})
+
+	// owned locally, kept here
+	if err := gee.Set("Tom", []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := gee.Get("Tom"); v.String() != "630" || v.Expire().IsZero() || loads != 0 {
+		t.Fatalf("Tom should be served from the cache, got %q", v.String())
+	}
+	if len(owner.set) != 0 {
+		t.Fatalf("a locally owned key should not be sent to peers")
+	}
+
+	// owned by the peer, sent there
+	if err := gee.SetWithTTL("Jack", []byte("589"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := owner.set["Jack"]; !ok || v.String() != "589" || !v.Expire().IsZero() {
+		t.Fatalf("the owner should get Jack, got %v", owner.set)
+	}
+	if gee.CacheStats(MainCache).Items != 1 {
+		t.Fatalf("Jack should not be kept by a node that does not own it")
+	}
+}
+
+func TestSetWithoutOwner(t *testing.T) {
+	gee := NewController("set-no-owner", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+
+	// every owner is down
+	up, down := &fakePeer{}, &fakePeer{down: true}
+	dict := &fakeReplicaDict{owners: []*fakePeer{down, down}, self: -1}
+	gee.RegisterPeers(dict)
+	if err := gee.Set("Tom", []byte("630")); err == nil || !strings.Contains(err.Error(), "no owner") {
+		t.Fatalf("a write nobody took should fail, got %v", err)
+	}
+
+	// one owner took it, the other one still missed it
+	dict.owners = []*fakePeer{down, up}
+	if err := gee.Set("Tom", []byte("630")); err == nil || strings.Contains(err.Error(), "no owner") {
+		t.Fatalf("expect the error of the owner that is down only, got %v", err)
+	}
+	if _, ok := up.set["Tom"]; !ok {
+		t.Fatalf("the owner that is up should get the write")
+	}
+
+	// a ring without any node
+	dict.owners = nil
+	if err := gee.Set("Tom", []byte("630")); err == nil {
+		t.Fatalf("a key without owner cannot be written")
+	}
+}
+
+func TestHandleSet(t *testing.T) {
+	loads := 0
+	gee := NewController("http-set", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999"})
+	client := server.newClient(remote.URL)
+
+	// between peers, with the envelope
+	expire := time.Now().Add(time.Minute)
+	if err := client.Set("http-set", "Tom", ByteView{value: []byte("630"), expire: expire}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := gee.Get("Tom"); v.String() != "630" || !v.Expire().Equal(expire) {
+		t.Fatalf("Tom should be stored with its expiration, got %q %v", v.String(), v.Expire())
+	}
+
+	// from a writer, with the raw value
+	req, _ := http.NewRequest(http.MethodPut, remote.URL+DEFAULT_BASE_PATH+"http-set/Jack", strings.NewReader("589"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %v %v", res, err)
+	}
+	res.Body.Close()
+	if v, _ := gee.Get("Jack"); v.String() != "589" || loads != 0 {
+		t.Fatalf("Jack should be stored, got %q", v.String())
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	loads := 0
+	NewController("http-not-found", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+	}), WithNegativeTTL(time.Minute))
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999"})
+
+	// 404 with or without the envelope
+	for _, accept := range []string{"", wire.CONTENT_TYPE} {
+		req := httptest.NewRequest(http.MethodGet, DEFAULT_BASE_PATH+"http-not-found/Tom", nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		server.ServeHTTP(res, req)
+		if res.Code != http.StatusNotFound {
+			t.Fatalf("accept %q: expect 404, got %d", accept, res.Code)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("the second request should hit the negative cache, loads %d", loads)
+	}
+
+	// the client turns it back into ErrNotFound
+	remote := httptest.NewServer(server)
+	defer remote.Close()
+	client := server.newClient(remote.URL)
+	if _, err := client.Lookup(context.Background(), "http-not-found", "Tom"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expect not found, got %v", err)
+	}
+
+	// a not found answer of the owner is final
+	gee := NewController("peer-not-found", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	gee.RegisterPeers(&fakePeerDict{owner: &fakePeer{notFound: true}})
+	if _, err := gee.Get("Tom"); !errors.Is(err, ErrNotFound) || loads != 1 {
+		t.Fatalf("the key should not be loaded locally, loads %d, err %v", loads, err)
+	}
+	if stats := gee.Stats(); stats.PeerErrors != 0 {
+		t.Fatalf("not found is not a peer error, got %+v", stats)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	gee := NewController("metrics", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	gee.Get("Tom")
+	gee.Get("Tom")
+
+	// a real peer, so that there is latency to record
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999"})
+	server.SetPeers("http://localhost:9999", remote.URL)
+	if _, err := server.httpClients[remote.URL].Get("metrics", "Tom"); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, DEFAULT_METRICS_PATH, nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.Code)
+	}
+
+	body := res.Body.String()
+	for _, line := range []string{
+		"# TYPE qecache_gets_total counter\n",
+		`qecache_hits_total{controller="metrics"} 2` + "\n",
+		`qecache_cache_items{controller="metrics",cache="main"} 1` + "\n",
+		`qecache_peer_request_duration_seconds_count{peer="` + remote.URL + `"} 1` + "\n",
+		`qecache_peer_request_duration_seconds_bucket{peer="` + remote.URL + `",le="+Inf"} 1` + "\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("metrics should contain %q, got\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `peer="http://localhost:9999"`) {
+		t.Fatalf("the current node is not a peer of itself")
+	}
+}
+
+func TestWireNegotiation(t *testing.T) {
+	NewController("wire", 2<<10, TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		if key == "unknown" {
+			return nil, 0, fmt.Errorf("%s not exist", key)
+		}
+		return []byte("630"), time.Hour, nil
+	}))
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+	client := &httpClient{baseURL: remote.URL + DEFAULT_BASE_PATH}
+
+	view, err := client.Lookup(context.Background(), "wire", "Tom")
+	if err != nil || view.String() != "630" {
+		t.Fatalf("unexpected lookup result %s, %v", view, err)
+	}
+	if until := time.Until(view.Expire()); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("expiration should be sent to the client, expires in %v", until)
+	}
+
+	if _, err := client.Lookup(context.Background(), "wire", "unknown"); err == nil || !strings.Contains(err.Error(), "unknown not exist") {
+		t.Fatalf("error message should be sent to the client, got %v", err)
+	}
+
+	// a client that does not know the envelope still gets raw bytes
+	res, err := http.Get(remote.URL + DEFAULT_BASE_PATH + "wire/Tom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.Header.Get("Content-Type") != "application/octet-stream" || string(body) != "630" {
+		t.Fatalf("old clients should get raw bytes, got %q", body)
+	}
+}
+
+func TestOldPeer(t *testing.T) {
+	// a peer that predates the envelope
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("630"))
+	}))
+	defer old.Close()
+	client := &httpClient{baseURL: old.URL + DEFAULT_BASE_PATH}
+
+	if view, err := client.Lookup(context.Background(), "wire", "Tom"); err != nil || view.String() != "630" || !view.Expire().IsZero() {
+		t.Fatalf("raw bytes of old peers should be accepted, got %s, %v", view, err)
+	}
+
+	// without the envelope, a missing key is told by the status alone
+	oldMiss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Tom not exist", http.StatusNotFound)
+	}))
+	defer oldMiss.Close()
+	client = &httpClient{baseURL: oldMiss.URL + DEFAULT_BASE_PATH}
+	if _, err := client.Lookup(context.Background(), "wire", "Tom"); !errors.Is(err, ErrNotFound) || err.Error() != "Tom not exist" {
+		t.Fatalf("a 404 of an old peer should be not found, got %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("630"))
+	}))
+	defer flaky.Close()
+
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999", RetryBackoff: time.Millisecond})
+	client := server.newClient(flaky.URL)
+	if view, err := client.Lookup(context.Background(), "retry", "Tom"); err != nil || view.String() != "630" || attempts != 3 {
+		t.Fatalf("transient failures should be retried, attempts %d, err %v", attempts, err)
+	}
+
+	attempts = 0
+	server = NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999", MaxRetries: -1})
+	client = server.newClient(flaky.URL)
+	if _, err := client.Lookup(context.Background(), "retry", "Tom"); err == nil || attempts != 1 {
+		t.Fatalf("retries should be disabled, attempts %d", attempts)
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer hung.Close()
+
+	server := NewHTTPServer(HTTPServerConfig{
+		SelfIP:       "http://localhost:9999",
+		PeerTimeout:  10 * time.Millisecond,
+		MaxRetries:   1,
+		RetryBackoff: time.Millisecond,
+	})
+	client := server.newClient(hung.URL)
+
+	start := time.Now()
+	if _, err := client.Lookup(context.Background(), "timeout", "Tom"); err == nil {
+		t.Fatalf("a hung peer should time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("two attempts should not take %v", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.record(false)
+	if !b.allow() {
+		t.Fatalf("one failure should not open the circuit")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatalf("two failures in a row should open the circuit")
+	}
+
+	now = now.Add(time.Second)
+	// picking the peer does not take the probe
+	if !b.available() || !b.available() {
+		t.Fatalf("the peer should be available for a probe after the cooldown")
+	}
+	if !b.allow() || b.allow() {
+		t.Fatalf("only one probe should be let through after the cooldown")
+	}
+	b.record(true)
+	if !b.allow() || b.health("peer").State != "closed" {
+		t.Fatalf("a successful probe should close the circuit")
+	}
+	if h := b.health("peer"); h.Failures != 2 || h.Successes != 1 || h.ConsecutiveFailures != 0 {
+		t.Fatalf("unexpected health %+v", h)
+	}
+}
+
+func TestSkipDeadPeer(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, BreakerThreshold: 2, MaxRetries: -1})
+	server.SetPeers(self, dead.URL)
+
+	// find a key owned by the dead peer
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := server.PeerOfKey(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		peer, ok := server.PeerOfKey(key)
+		if !ok {
+			t.Fatalf("the circuit should still be closed")
+		}
+		if _, err := peer.(LookupPeer).Lookup(context.Background(), "dead", key); err == nil {
+			t.Fatalf("a dead peer should fail")
+		}
+	}
+	if _, ok := server.PeerOfKey(key); ok {
+		t.Fatalf("the dead peer should be skipped once its circuit is open")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, DEFAULT_ADMIN_PATH, nil)
+	res := httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	var health []PeerHealth
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if len(health) != 1 || health[0].Peer != dead.URL || health[0].State != "open" || health[0].FailureRate != 1 {
+		t.Fatalf("unexpected peer health %+v", health)
+	}
+}
+
+// An open circuit only spares lookups. Writes and invalidations still go
+// to the owner, or it would keep serving the old value
+func TestBreakerWrites(t *testing.T) {
+	requests := make(map[string]int)
+	var mu sync.Mutex
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests[r.Method]++
+	}))
+	defer owner.Close()
+
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, BreakerThreshold: 1})
+	server.SetPeers(self, owner.URL)
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := server.PeerOfKey(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+	// a single transient failure opens the circuit
+	server.breakers[owner.URL].record(false)
+
+	loads := 0
+	gee := NewController("breaker-writes", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}))
+	gee.RegisterPeers(server)
+
+	if _, err := gee.Get(key); err != nil || loads != 1 {
+		t.Fatalf("the lookup should skip the owner, loads %d, err %v", loads, err)
+	}
+	if err := gee.Remove(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := gee.Set(key, []byte("630")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests[http.MethodGet] != 0 || requests[http.MethodDelete] != 1 || requests[http.MethodPut] != 1 {
+		t.Fatalf("expect a DELETE and a PUT only, got %v", requests)
+	}
+}
+
+func TestAddRemovePeer(t *testing.T) {
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self})
+	server.SetPeers(self, "http://a", "http://b")
+	server.AddPeer("http://c")
+	client := server.httpClients["http://a"]
+
+	owners := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		owners[key] = server.peers.Get(key)
+	}
+
+	server.RemovePeer("http://c")
+	for key, owner := range owners {
+		now := server.peers.Get(key)
+		if owner != "http://c" && now != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+		if now == "http://c" {
+			t.Fatalf("key %s is still owned by the removed peer", key)
+		}
+	}
+	if server.httpClients["http://a"] != client {
+		t.Fatalf("the client of a remaining peer should be reused")
+	}
+
+	// adding it back restores the ring, so does SetPeers with the same list
+	server.AddPeer("http://c")
+	server.SetPeers(self, "http://a", "http://b", "http://c")
+	for key, owner := range owners {
+		if now := server.peers.Get(key); now != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+	}
+	if server.httpClients["http://a"] != client {
+		t.Fatalf("SetPeers should reuse the client of a remaining peer")
+	}
+}
+
+func TestPeerWeights(t *testing.T) {
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{
+		SelfIP:      self,
+		PeerWeights: map[string]int{"http://large": 8},
+	})
+	server.SetPeers(self, "http://small", "http://large")
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[server.peers.Get(fmt.Sprint(i))]++
+	}
+	// 8 out of 10 in theory
+	if counts["http://large"] < 6000 {
+		t.Fatalf("the heavy peer should own most keys, got %v", counts)
+	}
+}
+
+func TestWeightedPeers(t *testing.T) {
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self})
+	server.SetWeightedPeers(WeightedPeer{Addr: self}, WeightedPeer{Addr: "http://small"}, WeightedPeer{Addr: "http://large", Weight: 8})
+
+	share := func() int {
+		count := 0
+		for i := 0; i < 10000; i++ {
+			if server.peers.Get(fmt.Sprint(i)) == "http://large" {
+				count++
+			}
+		}
+		return count
+	}
+	if count := share(); count < 6000 {
+		t.Fatalf("the heavy peer should own most keys, got %d", count)
+	}
+
+	// the peer is already there, only its weight changes
+	client := server.httpClients["http://large"]
+	server.AddWeightedPeer(WeightedPeer{Addr: "http://large", Weight: 1})
+	if count := share(); count > 5000 {
+		t.Fatalf("the peer should lose its weight, got %d", count)
+	}
+	if server.httpClients["http://large"] != client {
+		t.Fatalf("re-weighing a peer should keep its client")
+	}
+}
+
+func TestPlacementWithoutClient(t *testing.T) {
+	self := "http://localhost:9999"
+	// the placement knows a node that is not a peer of the server
+	placement := consistenthash.NewRendezvous(nil)
+	placement.Add("http://ghost")
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, Placement: placement, Replicas: 2})
+	server.SetPeers(self)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		if peer, ok := server.PeerOfKey(key); ok {
+			t.Fatalf("a node without a client should not be picked, got %v", peer)
+		}
+		if peers, _ := server.OwnersOfKey(key); len(peers) != 0 {
+			t.Fatalf("a node without a client should be skipped, got %v", peers)
+		}
+		server.FallbackOfKey(key)
+	}
+}
+
+// a ring that records the requests in flight
+type trackingPlacement struct {
+	consistenthash.Placement
+	inc, done map[string]int
+}
+
+func (p *trackingPlacement) Inc(node string)  { p.inc[node]++ }
+func (p *trackingPlacement) Done(node string) { p.done[node]++ }
+
+func TestPlacement(t *testing.T) {
+	NewController("placement", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+
+	placement := &trackingPlacement{
+		Placement: consistenthash.NewRendezvous(nil),
+		inc:       make(map[string]int),
+		done:      make(map[string]int),
+	}
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, Placement: placement})
+	server.SetPeers(self, remote.URL)
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if _, ok := server.PeerOfKey(fmt.Sprint(i)); ok {
+			key = fmt.Sprint(i)
+		}
+	}
+	peer, _ := server.PeerOfKey(key)
+	if _, err := peer.Get("placement", key); err != nil {
+		t.Fatal(err)
+	}
+	if placement.inc[remote.URL] != 1 || placement.done[remote.URL] != 1 {
+		t.Fatalf("the request should be tracked, got %v and %v", placement.inc, placement.done)
+	}
+}
+
+func TestBoundedCountsLocalLoads(t *testing.T) {
+	started, unblock := make(chan struct{}), make(chan struct{})
+	gee := NewController("bounded-local", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		started <- struct{}{}
+		<-unblock
+		return []byte(key), nil
+	}))
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+
+	self := "http://localhost:9999"
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, Placement: consistenthash.NewBounded(DEFAULT_VNODE_SCALAR, 0, nil)})
+	server.SetPeers(self, remote.URL)
+	gee.RegisterPeers(server)
+	t.Cleanup(gee.Close)
+
+	// keys the current node owns while it is idle
+	var keys []string
+	for i := 0; len(keys) < 3; i++ {
+		if _, ok := server.PeerOfKey(fmt.Sprint(i)); !ok {
+			keys = append(keys, fmt.Sprint(i))
+		}
+	}
+
+	// 2 loads in flight, both local: a third one would go beyond the bound
+	var wg sync.WaitGroup
+	for _, key := range keys[:2] {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			gee.Get(key)
+		}(key)
+		<-started
+	}
+	if _, ok := server.PeerOfKey(keys[2]); !ok {
+		t.Fatalf("a loaded node should pass its keys on to the next one")
+	}
+
+	close(unblock)
+	wg.Wait()
+	if _, ok := server.PeerOfKey(keys[2]); ok {
+		t.Fatalf("the key should come back once the loads are over")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	loads := 0
+	fetcher := FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	})
+
+	// not an owner: the primary is down, the next replica answers
+	primary, replica := &fakePeer{down: true}, &fakePeer{}
+	gee := NewController("replicas", 2<<10, fetcher, WithHotCacheSampling(-1))
+	gee.RegisterPeers(&fakeReplicaDict{owners: []*fakePeer{primary, replica}, self: -1})
+	if v, err := gee.Get("Tom"); err != nil || v.String() != "remote Tom" {
+		t.Fatalf("the replica should answer, got %q %v", v.String(), err)
+	}
+	if primary.gets != 1 || replica.gets != 1 || loads != 0 {
+		t.Fatalf("ask the primary then the replica, got %d %d %d", primary.gets, replica.gets, loads)
+	}
+
+	// the second owner: keep the value of the primary
+	primary = &fakePeer{}
+	gee = NewController("replicas", 2<<10, fetcher, WithHotCacheSampling(-1))
+	after := &fakePeer{}
+	gee.RegisterPeers(&fakeReplicaDict{owners: []*fakePeer{primary, after}, self: 1})
+	gee.Get("Tom")
+	gee.Get("Tom")
+	if primary.gets != 1 || after.gets != 0 {
+		t.Fatalf("a replica should keep what the primary sent, got %d gets", primary.gets)
+	}
+
+	// the second owner, the primary is down: load rather than asking the third
+	primary.down = true
+	gee.Get("Jack")
+	if loads != 1 || after.gets != 0 {
+		t.Fatalf("a replica should take over the load, got %d loads", loads)
+	}
+
+	// invalidations reach every owner
+	if err := gee.Remove("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.removed) != 1 || len(after.removed) != 1 {
+		t.Fatalf("every owner should be asked to remove Tom")
+	}
+}
+
+func TestOwnersOfKey(t *testing.T) {
+	self := "http://localhost:9999"
+	placement := consistenthash.NewRendezvous(nil)
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, Placement: placement, Replicas: 2})
+	server.SetPeers(self, "http://a", "http://b")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		want := placement.GetN(key, 2)
+		peers, selfIndex := server.OwnersOfKey(key)
+
+		var got []string
+		for _, peer := range peers {
+			got = append(got, peer.(*httpClient).peer)
+		}
+		if selfIndex >= 0 {
+			got = slices.Insert(got, selfIndex, self)
+		}
+		if !slices.Equal(got, want) {
+			t.Fatalf("owners of %s should be %v, got %v", key, want, got)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	loads := 0
+	gee := NewController("fallback", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		return []byte(key), nil
+	}), WithHotCacheSampling(0))
+	owner, fallback := &fakePeer{down: true}, &fakePeer{}
+	gee.RegisterPeers(&fakeFallbackDict{fakePeerDict: fakePeerDict{owner: owner}, fallback: fallback})
+
+	// the owner is dead, the fallback loads it rather than this node
+	if v, err := gee.Get("Tom"); err != nil || v.String() != "remote Tom" {
+		t.Fatalf("the fallback should answer, got %q %v", v.String(), err)
+	}
+	if loads != 0 || fallback.fallbacks != 1 {
+		t.Fatalf("expect a fallback lookup and no local load, got %d loads %d fallbacks", loads, fallback.fallbacks)
+	}
+
+	// the fallback is dead as well, the last resort is to load locally
+	fallback.down = true
+	if v, err := gee.Get("Jack"); err != nil || v.String() != "Jack" || loads != 1 {
+		t.Fatalf("expect a local load, got %q %v", v.String(), err)
+	}
+
+	// a fallback lookup is loaded here, the owner is not asked
+	owner.down = false
+	gets := owner.gets
+	if _, err := gee.GetContext(withFallback(context.Background()), "Sam"); err != nil || loads != 2 || owner.gets != gets {
+		t.Fatalf("a fallback lookup should be loaded locally, loads %d", loads)
+	}
+}
+
+// Several nodes lose the owner of a key at once. They all turn to the
+// same fallback, which loads the key once for all of them
+func TestFallbackLease(t *testing.T) {
+	var loads atomic.Int32
+	gee := NewController("fallback-lease", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		loads.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return []byte(key), nil
+	}))
+	// the owner as the fallback node sees it
+	owner := &fakePeer{down: true}
+	gee.RegisterPeers(&fakePeerDict{owner: owner})
+
+	fallbackNode := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://fallback"}))
+	defer fallbackNode.Close()
+
+	// the nodes that lost the owner, asking the fallback
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		node := NewHTTPServer(HTTPServerConfig{SelfIP: fmt.Sprintf("http://node-%d", i)})
+		client := node.newClient(fallbackNode.URL)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := client.Lookup(withFallback(context.Background()), "fallback-lease", "Tom")
+			if err != nil || v.String() != "Tom" {
+				t.Errorf("unexpected lookup result %q %v", v.String(), err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("the key should be loaded once for the cluster, got %d", n)
+	}
+	if owner.gets != 0 {
+		t.Fatalf("the fallback should not ask the dead owner")
+	}
+}
+
+func TestFallbackOfKey(t *testing.T) {
+	self := "http://localhost:9999"
+	placement := consistenthash.New(DEFAULT_VNODE_SCALAR, nil)
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: self, Placement: placement})
+	server.SetPeers(self, "http://a", "http://b")
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		want := placement.GetN(key, 2)[1]
+		peer, ok := server.FallbackOfKey(key)
+		if want == self && ok {
+			t.Fatalf("the current node is the fallback of %s, got %v", key, peer)
+		}
+		if want != self && (!ok || peer.(*httpClient).peer != want) {
+			t.Fatalf("the fallback of %s should be %s, got %v", key, want, peer)
+		}
+	}
+}
+
+func TestGetMultiPeers(t *testing.T) {
+	var fetched [][]string
+	gee := NewController("multi-peers", 2<<10, BatchFetcherFunc(
+		func(ctx context.Context, keys []string) (map[string][]byte, time.Duration, error) {
+			fetched = append(fetched, keys)
+			return map[string][]byte{"Tom": []byte("630")}, 0, nil
+		}), WithHotCacheSampling(0))
+	owner := &fakePeer{}
+	gee.RegisterPeers(&fakePeerDict{owner: owner, local: map[string]bool{"Tom": true}})
+
+	values, err := gee.GetMulti([]string{"Tom", "Jack", "Sam"})
+	if err != nil || len(values) != 3 || values["Tom"].String() != "630" || values["Sam"].String() != "remote Sam" {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+	// one request for the peer, one call of the fetcher for the rest
+	if owner.batches != 1 || owner.gets != 2 || !reflect.DeepEqual(fetched, [][]string{{"Tom"}}) {
+		t.Fatalf("expect one batch each, got %d to the peer, fetched %v", owner.batches, fetched)
+	}
+
+	// a peer that can't be reached is not asked again key by key,
+	// the current node loads the keys as a last resort
+	down := NewController("multi-peers-down", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	dead := &fakePeer{down: true}
+	down.RegisterPeers(&fakePeerDict{owner: dead})
+	values, err = down.GetMulti([]string{"Jack", "Sam"})
+	if err != nil || values["Jack"].String() != "Jack" || dead.batches != 1 || dead.gets != 0 {
+		t.Fatalf("unexpected result %v, %v, peer got %d batches %d gets", values, err, dead.batches, dead.gets)
+	}
+	if stats := down.Stats(); stats.LoadsDeduped != 0 || stats.PeerErrors != 1 {
+		t.Fatalf("a batch shares no load and fails once, got %+v", stats)
+	}
+
+	// the keys a batch failed to get go to the next owner instead
+	second := &fakePeer{}
+	flaky := &failingKeysPeer{fail: map[string]bool{"Jack": true}}
+	replicas := NewController("multi-peers-replicas", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		t.Fatalf("%s should be loaded by the second owner", key)
+		return nil, nil
+	}))
+	replicas.RegisterPeers(&mixedReplicaDict{owners: []RemotePeer{flaky, second}})
+	values, err = replicas.GetMulti([]string{"Jack", "Sam"})
+	if err != nil || values["Jack"].String() != "remote Jack" || values["Sam"].String() != "flaky Sam" {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+	if flaky.batches != 1 || flaky.gets != 0 || second.gets != 1 {
+		t.Fatalf("Jack should only be retried on the second owner, got %d batches %d gets, second %d gets",
+			flaky.batches, flaky.gets, second.gets)
+	}
+
+	// the answers of the owner are final, as for a single key
+	missing := NewController("multi-peers-missing", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		t.Fatalf("%s should not be loaded locally", key)
+		return nil, nil
+	}))
+	missing.RegisterPeers(&fakePeerDict{owner: &fakePeer{notFound: true}})
+	if values, err := missing.GetMulti([]string{"Jack", "Sam"}); err != nil || len(values) != 0 {
+		t.Fatalf("missing keys should be left out, got %v, %v", values, err)
+	}
+}
+
+// a peer that fails some keys of a batch
+type failingKeysPeer struct {
+	fail    map[string]bool
+	batches int
+	gets    int
+}
+
+func (p *failingKeysPeer) Get(namespace string, key string) ([]byte, error) {
+	p.gets++
+	return []byte("flaky " + key), nil
+}
+
+func (p *failingKeysPeer) LookupMulti(ctx context.Context, namespace string, keys []string) ([]LookupResult, error) {
+	p.batches++
+	results := make([]LookupResult, len(keys))
+	for i, key := range keys {
+		if p.fail[key] {
+			results[i].Err = fmt.Errorf("cannot load %s", key)
+			continue
+		}
+		results[i].Value = ByteView{value: []byte("flaky " + key)}
+	}
+	return results, nil
+}
+
+// every key is owned by the same peers, the current node is not one of them
+type mixedReplicaDict struct {
+	owners []RemotePeer
+}
+
+func (d *mixedReplicaDict) PeerOfKey(key string) (RemotePeer, bool) {
+	return d.owners[0], true
+}
+
+func (d *mixedReplicaDict) OwnersOfKey(key string) ([]RemotePeer, int) {
+	return d.owners, -1
+}
+
+// a peer that can't be a map key
+type unhashablePeer struct {
+	tags []string
+}
+
+func (p unhashablePeer) Get(namespace string, key string) ([]byte, error) {
+	return []byte("remote " + key), nil
+}
+
+func TestGetMultiUnhashablePeer(t *testing.T) {
+	gee := NewController("multi-unhashable", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	gee.RegisterPeers(getOnlyDict{peer: unhashablePeer{tags: []string{"a"}}})
+	values, err := gee.GetMulti([]string{"Tom", "Jack"})
+	if err != nil || values["Tom"].String() != "remote Tom" || values["Jack"].String() != "remote Jack" {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+}
+
+func TestHTTPGetMulti(t *testing.T) {
+	NewController("http-multi", 2<<10, TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		switch key {
+		case "unknown":
+			return nil, 0, fmt.Errorf("%s: %w", key, ErrNotFound)
+		case "broken":
+			return nil, 0, fmt.Errorf("connection reset")
+		}
+		return []byte(key), time.Hour, nil
+	}))
+	remote := httptest.NewServer(NewHTTPServer(HTTPServerConfig{SelfIP: "http://remote"}))
+	defer remote.Close()
+	client := &httpClient{baseURL: remote.URL + DEFAULT_BASE_PATH}
+
+	results, err := client.LookupMulti(context.Background(), "http-multi", []string{"Tom", "unknown", "broken", "Tom"})
+	if err != nil || len(results) != 4 {
+		t.Fatalf("unexpected results %v, %v", results, err)
+	}
+	if results[0].Value.String() != "Tom" || results[0].Value.Expire().IsZero() || results[3].Value.String() != "Tom" {
+		t.Fatalf("values should come with their expiration, got %v", results)
+	}
+	if !errors.Is(results[1].Err, ErrNotFound) {
+		t.Fatalf("expect not found, got %v", results[1].Err)
+	}
+	if results[2].Err == nil || !strings.Contains(results[2].Err.Error(), "connection reset") {
+		t.Fatalf("errors of the fetcher should reach the client, got %v", results[2].Err)
+	}
+
+	if _, err := client.LookupMulti(context.Background(), "no-such-controller", []string{"Tom"}); err == nil {
+		t.Fatalf("unknown controller should be an error")
+	}
+
+	// the envelope is the only format
+	res, err := http.Post(remote.URL+DEFAULT_BASE_PATH+"http-multi", "application/octet-stream", strings.NewReader("Tom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect 400, got %d", res.StatusCode)
+	}
+
+	// too many keys, or too many bytes, in a single request
+	many := make([]string, MAX_BATCH_KEYS+1)
+	for i := range many {
+		many[i] = fmt.Sprint(i)
+	}
+	tooMany, _ := (&wire.BatchRequest{Namespace: "http-multi", Keys: many}).MarshalBinary()
+	for _, body := range [][]byte{tooMany, make([]byte, MAX_BATCH_BYTES+1)} {
+		res, err := http.Post(remote.URL+DEFAULT_BASE_PATH+"http-multi", wire.CONTENT_TYPE, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("expect 413, got %d", res.StatusCode)
+		}
+	}
+
+	// the client splits a large batch
+	results, err = client.LookupMulti(context.Background(), "http-multi", append(many, many...))
+	if err != nil || len(results) != 2*len(many) || results[len(many)].Value.String() != "0" {
+		t.Fatalf("a large batch should be split, got %d results, %v", len(results), err)
+	}
+}
+
+func TestGetMultiBaselinePeer(t *testing.T) {
+	gee := NewController("multi-baseline", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		t.Fatalf("%s should be asked to the peer", key)
+		return nil, nil
+	}), WithHotCacheSampling(0))
+
+	// a peer of the first version: GET /<basepath>/<controller>/<key>
+	// only, any path without a key is a bad request
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method]++
+		mu.Unlock()
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, DEFAULT_BASE_PATH), "/", 2)
+		if len(parts) != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte("old " + parts[1]))
+	}))
+	defer old.Close()
+
+	server := NewHTTPServer(HTTPServerConfig{SelfIP: "http://localhost:9999"})
+	server.SetPeers(old.URL)
+	gee.RegisterPeers(server)
+
+	values, err := gee.GetMulti([]string{"Tom", "Jack", "Sam"})
+	if err != nil || len(values) != 3 || values["Sam"].String() != "old Sam" {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests[http.MethodPost] != 1 || requests[http.MethodGet] != 3 {
+		t.Fatalf("expect a batch then one GET per key, got %v", requests)
+	}
+	if stats := gee.Stats(); stats.PeerErrors != 0 || stats.PeerLoads != 3 {
+		t.Fatalf("a peer without batches is not failing, got %+v", stats)
+	}
+}
+
+func TestGetOnlyPeer(t *testing.T) {
+	gee := NewController("get-only", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		t.Fatalf("%s should be asked to the peer", key)
+		return nil, nil
+	}), WithHotCacheSampling(0))
+	peer := &getOnlyPeer{}
+	gee.RegisterPeers(getOnlyDict{peer: peer})
+
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "remote Tom" {
+		t.Fatalf("unexpected result %v, %v", view, err)
+	}
+	// no batches, the keys are asked one by one
+	values, err := gee.GetMulti([]string{"Jack", "Sam"})
+	if err != nil || values["Sam"].String() != "remote Sam" || peer.gets.Load() != 3 {
+		t.Fatalf("unexpected result %v, %v, %d gets", values, err, peer.gets.Load())
+	}
+
+	if err := gee.Remove("Tom"); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expect unsupported, got %v", err)
+	}
+	if err := gee.Set("Tom", []byte("630")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("expect unsupported, got %v", err)
+	}
+}
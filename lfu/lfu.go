@@ -0,0 +1,189 @@
+/*
+Least frequently used eviction.
+The entry that was read the least number of times goes first.
+Among entries read equally often, the least recently touched one goes first.
+*/
+package lfu
+
+import (
+	"QECache/eviction"
+	"container/heap"
+	"time"
+)
+
+// Simple LFU data structure (dictionary). Not safe for concurrent access
+type LFUDict struct {
+	// Give 0 for assuming infinite capacity
+	maxBytes  int64
+	usedBytes int64
+	// a min heap ordered by (freq, tick), the root is the next victim
+	queue entryHeap
+	// Cache data as a map
+	cache map[string]*entry
+	// increases on every access, used to break ties of freq
+	tick uint64
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value eviction.Value)
+	// the clock used to decide expiration. Replaceable for testing
+	now func() time.Time
+}
+
+type entry struct {
+	key    string
+	value  eviction.Value
+	expire time.Time
+	// how many times it has been accessed
+	freq uint64
+	// when it was last accessed
+	tick uint64
+	// position in the heap, maintained by entryHeap
+	index int
+}
+
+func New(maxBytes int64, onEvicted func(string, eviction.Value)) *LFUDict {
+	return &LFUDict{
+		maxBytes:  maxBytes,
+		cache:     make(map[string]*entry),
+		OnEvicted: onEvicted,
+		now:       time.Now,
+	}
+}
+
+func (c *LFUDict) Get(key string) (value eviction.Value, ok bool) {
+	e, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	if eviction.Expired(e.expire, c.now()) {
+		c.removeEntry(e)
+		return nil, false
+	}
+
+	c.touch(e)
+	return e.value, true
+}
+
+func (c *LFUDict) Add(key string, value eviction.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+func (c *LFUDict) AddWithTTL(key string, value eviction.Value, ttl time.Duration) {
+	c.tick++
+	e := &entry{
+		key:    key,
+		value:  value,
+		expire: eviction.ExpireAt(c.now(), ttl),
+		freq:   1,
+		tick:   c.tick,
+	}
+
+	if old, ok := c.cache[key]; ok {
+		// an update keeps the popularity of the key
+		e.freq = old.freq + 1
+		heap.Remove(&c.queue, old.index)
+		delete(c.cache, key)
+		c.usedBytes -= int64(len(key)) + int64(old.value.Len())
+	}
+
+	// make room before inserting.
+	// Otherwise the new entry, used only once, would be the first to go
+	size := int64(len(key)) + int64(value.Len())
+	for c.maxBytes != 0 && c.usedBytes+size > c.maxBytes && c.queue.Len() > 0 {
+		c.RemoveOldest()
+	}
+
+	heap.Push(&c.queue, e)
+	c.cache[key] = e
+	c.usedBytes += size
+}
+
+func (c *LFUDict) Remove(key string) bool {
+	if e, ok := c.cache[key]; ok {
+		c.removeEntry(e)
+		return true
+	}
+	return false
+}
+
+func (c *LFUDict) RemoveOldest() {
+	if c.queue.Len() > 0 {
+		c.removeEntry(c.queue[0])
+	}
+}
+
+func (c *LFUDict) RemoveExpired() int {
+	now := c.now()
+	var expired []*entry
+	for _, e := range c.queue {
+		if eviction.Expired(e.expire, now) {
+			expired = append(expired, e)
+		}
+	}
+	for _, e := range expired {
+		c.removeEntry(e)
+	}
+	return len(expired)
+}
+
+func (c *LFUDict) Len() int {
+	return c.queue.Len()
+}
+
+func (c *LFUDict) UsedBytes() int64 {
+	return c.usedBytes
+}
+
+// record an access, which moves the entry away from the heap root
+func (c *LFUDict) touch(e *entry) {
+	c.tick++
+	e.freq++
+	e.tick = c.tick
+	heap.Fix(&c.queue, e.index)
+}
+
+func (c *LFUDict) removeEntry(e *entry) {
+	heap.Remove(&c.queue, e.index)
+	delete(c.cache, e.key)
+	c.usedBytes -= int64(len(e.key)) + int64(e.value.Len())
+
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+var _ eviction.Policy = (*LFUDict)(nil)
+
+// entryHeap implements heap.Interface
+// See the PriorityQueue example of container/heap
+type entryHeap []*entry
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *entryHeap) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *entryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil // let GC collect it
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
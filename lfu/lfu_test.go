@@ -0,0 +1,30 @@
+package lfu
+
+import (
+	"testing"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestEvictLeastFrequent(t *testing.T) {
+	// room for exactly two entries
+	lfu := New(int64(len("k1v1k2v2")), nil)
+	lfu.Add("k1", String("v1"))
+	lfu.Add("k2", String("v2"))
+	// k1 is read more often, although k2 is more recent
+	lfu.Get("k1")
+	lfu.Get("k1")
+	lfu.Get("k2")
+
+	lfu.Add("k3", String("v3"))
+	if _, ok := lfu.Get("k2"); ok {
+		t.Fatalf("k2 is the least frequently used and should be evicted")
+	}
+	if _, ok := lfu.Get("k1"); !ok {
+		t.Fatalf("k1 should be kept")
+	}
+}
@@ -0,0 +1,173 @@
+// Limits on the calls to the fetcher.
+// singleflight merges the loads of the same key, but a cold cluster
+// still loads many different keys at once. The limiter caps how many
+// fetches run at the same time and how many start per second. Loads over
+// the limits queue up for a while, then are shed with ErrLoadShed.
+package qecache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Returned, wrapped, when a load waited too long for the limiter.
+// Unlike other errors, the data source was not even asked
+var ErrLoadShed = errors.New("load shed")
+
+// How long a load may queue for the limiter by default
+const DEFAULT_MAX_FETCH_WAIT = time.Second
+
+// At most n calls to the fetcher run at the same time.
+// The others queue up, in order, see WithMaxFetchWait.
+// 0, the default, means no limit
+func WithMaxConcurrentFetches(n int) ControllerOption {
+	return func(c *Controller) {
+		c.limiter.maxConcurrent = n
+	}
+}
+
+// At most qps calls to the fetcher start per second on average, with
+// bursts of up to burst calls after a quiet period.
+// 0, the default, means no limit
+func WithFetchRate(qps float64, burst int) ControllerOption {
+	return func(c *Controller) {
+		c.limiter.qps = qps
+		c.limiter.burst = burst
+	}
+}
+
+// How long a load may queue for the limits above before it is shed.
+// DEFAULT_MAX_FETCH_WAIT by default
+func WithMaxFetchWait(wait time.Duration) ControllerOption {
+	return func(c *Controller) {
+		c.limiter.maxWait = wait
+	}
+}
+
+type fetchLimiter struct {
+	// the settings, set by the options
+	maxConcurrent int
+	qps           float64
+	burst         int
+	maxWait       time.Duration
+
+	// a slot is taken by each running fetch. nil means no limit.
+	// Goroutines blocked on a channel are served in order, so it is
+	// also the queue
+	slots chan struct{}
+	// nil means no limit
+	bucket *tokenBucket
+}
+
+// build the limiter from its settings, once the options are applied
+func (l *fetchLimiter) init() {
+	if l.maxWait == 0 {
+		l.maxWait = DEFAULT_MAX_FETCH_WAIT
+	}
+	if l.maxConcurrent > 0 {
+		l.slots = make(chan struct{}, l.maxConcurrent)
+	}
+	if l.qps > 0 {
+		l.bucket = newTokenBucket(l.qps, max(l.burst, 1))
+	}
+}
+
+// Wait for the right to call the fetcher.
+// Call release once the fetcher returns
+func (l *fetchLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l.slots == nil && l.bucket == nil {
+		return func() {}, nil
+	}
+
+	deadline := time.Now().Add(l.maxWait)
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+
+	// the slot first: a token taken while waiting for a slot would be
+	// wasted if the load is shed
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, fmt.Errorf("%w: no fetch slot within %v", ErrLoadShed, l.maxWait)
+		}
+	}
+	release = func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+
+	if l.bucket != nil {
+		wait, ok := l.bucket.reserve(time.Until(deadline))
+		if !ok {
+			// no need to wait, the token would come too late anyway
+			release()
+			return nil, fmt.Errorf("%w: over %v fetches per second", ErrLoadShed, l.qps)
+		}
+		if wait > 0 {
+			tokenTimer := time.NewTimer(wait)
+			defer tokenTimer.Stop()
+			select {
+			case <-tokenTimer.C:
+			case <-ctx.Done():
+				// the token stays used, the caller was just too late
+				release()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return release, nil
+}
+
+// The classic token bucket: it fills at rate tokens per second up to
+// burst, and each fetch takes a token.
+// Tokens can be reserved ahead, which makes the bucket go negative, so
+// that waiting callers are served in order.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// the clock, replaced in tests
+	now func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Take a token, and tell how long to wait before it is really there.
+// Takes nothing and returns false if that is longer than maxWait
+func (b *tokenBucket) reserve(maxWait time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+
+	wait := time.Duration(0)
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+	}
+	if wait > maxWait {
+		return 0, false
+	}
+	b.tokens--
+	return wait, true
+}
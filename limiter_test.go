@@ -0,0 +1,115 @@
+package qecache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	var running, most atomic.Int32
+	gee := NewController("max-concurrent", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		return []byte(key), nil
+	}), WithMaxConcurrentFetches(2), WithMaxFetchWait(time.Second))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			// they queue up, none is shed
+			if _, err := gee.Get(key); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+
+	if n := most.Load(); n != 2 {
+		t.Fatalf("expect 2 fetches at most at the same time, got %d", n)
+	}
+}
+
+func TestLoadShed(t *testing.T) {
+	release := make(chan struct{})
+	gee := NewController("load-shed", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		<-release
+		return []byte(key), nil
+	}), WithMaxConcurrentFetches(1), WithMaxFetchWait(20*time.Millisecond))
+
+	go gee.Get("Tom")
+	// wait for Tom to take the only slot
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := gee.Get("Jack"); !errors.Is(err, ErrLoadShed) {
+		t.Fatalf("expect the load to be shed, got %v", err)
+	}
+	if stats := gee.Stats(); stats.LoadsShed != 1 || stats.LocalLoadErrs != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	close(release)
+	if v, err := gee.Get("Jack"); err != nil || v.String() != "Jack" {
+		t.Fatalf("a shed load should not be cached, got %v", err)
+	}
+
+	// peers learn it was shed
+	if _, err := ViewOfResponse(ResponseOfView(ByteView{}, fmt.Errorf("%w", ErrLoadShed))); !errors.Is(err, ErrLoadShed) {
+		t.Fatalf("expect ErrLoadShed from the envelope, got %v", err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2)
+	b.now = func() time.Time { return now }
+	b.last = now
+
+	// the burst is free
+	for i := 0; i < 2; i++ {
+		if wait, ok := b.reserve(0); !ok || wait != 0 {
+			t.Fatalf("expect a token at once, got %v %v", wait, ok)
+		}
+	}
+	// then one every 100ms
+	if _, ok := b.reserve(50 * time.Millisecond); ok {
+		t.Fatalf("the next token comes in 100ms, more than the max wait")
+	}
+	if wait, ok := b.reserve(time.Second); !ok || wait != 100*time.Millisecond {
+		t.Fatalf("expect to wait 100ms, got %v %v", wait, ok)
+	}
+	// reserved tokens queue up
+	if wait, ok := b.reserve(time.Second); !ok || wait != 200*time.Millisecond {
+		t.Fatalf("expect to wait 200ms, got %v %v", wait, ok)
+	}
+
+	now = now.Add(time.Second)
+	if wait, ok := b.reserve(0); !ok || wait != 0 {
+		t.Fatalf("the bucket should have refilled, got %v %v", wait, ok)
+	}
+}
+
+func TestFetchRate(t *testing.T) {
+	gee := NewController("fetch-rate", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithFetchRate(1, 1), WithMaxFetchWait(10*time.Millisecond))
+
+	if _, err := gee.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gee.Get("Jack"); !errors.Is(err, ErrLoadShed) {
+		t.Fatalf("expect the load to be shed, got %v", err)
+	}
+}
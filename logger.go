@@ -0,0 +1,26 @@
+// Leveled, structured logging
+package qecache
+
+import "log/slog"
+
+// The logger used by controllers and servers.
+// The args are alternating keys and values, e.g.
+//
+//	logger.Debug("hit", "controller", "scores", "key", "Tom")
+//
+// *slog.Logger implements it, so does any logger following the same shape.
+// Requests are logged at Debug level, so they are silent by default.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// the logger used when none is given.
+// It is looked up each time so that slog.SetDefault takes effect
+func defaultLogger() Logger {
+	return slog.Default()
+}
+
+var _ Logger = (*slog.Logger)(nil)
@@ -1,7 +1,9 @@
 package lru
 
 import (
+	"QECache/eviction"
 	"container/list"
+	"time"
 )
 
 // Simple LRU data structure (dictionary). Not safe for concurrent access
@@ -15,6 +17,8 @@ type LRUDict struct {
 	cache map[string]*list.Element
 	// optional and executed when an entry is purged.
 	OnEvicted func(key string, value Value)
+	// the clock used to decide expiration. Replaceable for testing
+	now func() time.Time
 }
 
 // the entry to save in cache
@@ -23,14 +27,19 @@ type LRUDict struct {
 type entry struct {
 	key   string
 	value Value
+	// when the entry becomes stale. Zero value means never.
+	expire time.Time
+}
+
+func (e *entry) expired(now time.Time) bool {
+	return eviction.Expired(e.expire, now)
 }
 
 // The value saved in the entry. Allow arbitrary type in principle.
+// It is an alias so that LRUDict satisfies eviction.Policy
 //
 // TODO: maybe use generics to introduce type
-type Value interface {
-	Len() int // how many bytes it takes
-}
+type Value = eviction.Value
 
 func New(maxBites int64, onEvicted func(string, Value)) *LRUDict {
 	return &LRUDict{
@@ -38,71 +47,122 @@ func New(maxBites int64, onEvicted func(string, Value)) *LRUDict {
 		ll:        list.New(),
 		cache:     make(map[string]*list.Element),
 		OnEvicted: onEvicted,
+		now:       time.Now,
 	}
 }
 
 // Get an entry as a method on Cache
+// Expired entries are removed lazily here, as if they were never there
 func (c *LRUDict) Get(key string) (value Value, ok bool) {
 	cacheNode, ok := c.cache[key]
-	if ok {
-		// Update the the accessed element to the front
-		// So that we keep track of recently usage
-		c.ll.MoveToFront(cacheNode)
-		entry := cacheNode.Value.(*entry)
-		return entry.value, true
+	if !ok {
+		// naked return as (nil, false)
+		return
+	}
+
+	entry := cacheNode.Value.(*entry)
+	if entry.expired(c.now()) {
+		c.removeElement(cacheNode)
+		return nil, false
 	}
 
-	// naked return as (nil, false)
-	return
+	// Update the the accessed element to the front
+	// So that we keep track of recently usage
+	c.ll.MoveToFront(cacheNode)
+	return entry.value, true
 }
 
 func (c *LRUDict) RemoveRLU() {
 	if rluEle := c.ll.Back(); rluEle != nil {
-		// need to remove the element from both dict and list
+		c.removeElement(rluEle)
+	}
+}
 
-		c.ll.Remove(rluEle)
-		entry := rluEle.Value.(*entry)
+// The least recently used entry is the one valued the least
+func (c *LRUDict) RemoveOldest() {
+	c.RemoveRLU()
+}
 
-		if _, ok := c.cache[entry.key]; ok {
-			// remove from dict
-			delete(c.cache, entry.key)
+// Remove all the entries that have expired.
+// It walks the whole list, so it is meant to be called periodically
+// by a background sweeper rather than on the hot path.
+// Returns how many entries were removed.
+func (c *LRUDict) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for ele := c.ll.Back(); ele != nil; {
+		// remember the next one before ele is unlinked
+		prev := ele.Prev()
+		if ele.Value.(*entry).expired(now) {
+			c.removeElement(ele)
+			removed++
 		}
+		ele = prev
+	}
+	return removed
+}
+
+// Remove an entry on purpose, e.g. because the source of truth changed.
+// Returns whether the key was present.
+// OnEvicted is called as well, just like any other way of leaving the cache
+func (c *LRUDict) Remove(key string) bool {
+	if ele, ok := c.cache[key]; ok {
+		c.removeElement(ele)
+		return true
+	}
+	return false
+}
 
-		c.usedBytes -= int64(len(entry.key)) + int64(entry.value.Len())
+// need to remove the element from both dict and list
+func (c *LRUDict) removeElement(ele *list.Element) {
+	c.ll.Remove(ele)
+	entry := ele.Value.(*entry)
 
-		if c.OnEvicted != nil {
-			c.OnEvicted(entry.key, entry.value)
-		}
+	delete(c.cache, entry.key)
+
+	c.usedBytes -= int64(len(entry.key)) + int64(entry.value.Len())
+
+	if c.OnEvicted != nil {
+		c.OnEvicted(entry.key, entry.value)
 	}
 }
 
+// Add an entry that never expires
 func (c *LRUDict) Add(key string, value Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+// Add an entry that expires after ttl.
+// A ttl <= 0 means the entry lives until evicted.
+func (c *LRUDict) AddWithTTL(key string, value Value, ttl time.Duration) {
+	expire := eviction.ExpireAt(c.now(), ttl)
+
 	if ele, ok := c.cache[key]; ok {
-		updateExisted(ele, c, key, value)
+		updateExisted(ele, c, value, expire)
 	} else {
-		addNew(c, key, value)
+		addNew(c, key, value, expire)
 	}
 }
 
-func updateExisted(ele *list.Element, c *LRUDict, key string, value Value) {
+func updateExisted(ele *list.Element, c *LRUDict, value Value, expire time.Time) {
 	entry := ele.Value.(*entry)
-	calcUsedBytes := func() int64 {
-		return c.usedBytes + int64(value.Len()) - int64(entry.value.Len())
-	}
-	// Try free space if update would cause overflow
-	for newUsedBytes := calcUsedBytes(); c.maxBytes != 0 && newUsedBytes > c.maxBytes; newUsedBytes = calcUsedBytes() {
-		c.RemoveRLU()
-	}
 
 	// update the value and used bytes
+	c.usedBytes += int64(value.Len()) - int64(entry.value.Len())
 	entry.value = value
-	c.usedBytes = int64(value.Len()) - int64(entry.value.Len())
+	entry.expire = expire
 
 	// update its frequency
 	c.ll.MoveToFront(ele)
+
+	// Try free space if the update caused overflow.
+	// The updated entry is at the front, so it is the last to go
+	for c.maxBytes != 0 && c.usedBytes > c.maxBytes && c.ll.Len() > 1 {
+		c.RemoveRLU()
+	}
 }
 
-func addNew(c *LRUDict, key string, value Value) {
+func addNew(c *LRUDict, key string, value Value, expire time.Time) {
 	calcUsedBytes := func() int64 {
 		return c.usedBytes + int64(value.Len()) + int64(len(key))
 	}
@@ -116,7 +176,7 @@ func addNew(c *LRUDict, key string, value Value) {
 	}
 
 	// insert a new element
-	ele := c.ll.PushFront(&entry{key, value})
+	ele := c.ll.PushFront(&entry{key, value, expire})
 	c.cache[key] = ele
 	c.usedBytes = calcUsedBytes()
 }
@@ -124,3 +184,10 @@ func addNew(c *LRUDict, key string, value Value) {
 func (c *LRUDict) Len() int {
 	return c.ll.Len()
 }
+
+// How many bytes the keys and values take in total
+func (c *LRUDict) UsedBytes() int64 {
+	return c.usedBytes
+}
+
+var _ eviction.Policy = (*LRUDict)(nil)
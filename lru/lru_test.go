@@ -3,6 +3,7 @@ package lru
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 type String string
@@ -56,3 +57,53 @@ func TestOnEvicted(t *testing.T) {
 		t.Fatalf("Call OnEvicted failed, expect keys equals to %s", expect)
 	}
 }
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	lru := New(int64(0), nil)
+	lru.now = func() time.Time { return now }
+
+	lru.AddWithTTL("short", String("1"), time.Second)
+	lru.AddWithTTL("long", String("2"), time.Hour)
+	lru.Add("forever", String("3"))
+
+	if _, ok := lru.Get("short"); !ok {
+		t.Fatalf("short should not expire yet")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := lru.Get("short"); ok {
+		t.Fatalf("short should have expired lazily")
+	}
+	if lru.Len() != 2 {
+		t.Fatalf("expired entry should be removed on get, len %d", lru.Len())
+	}
+
+	now = now.Add(24 * time.Hour)
+	if removed := lru.RemoveExpired(); removed != 1 {
+		t.Fatalf("expect 1 entry swept, got %d", removed)
+	}
+	if _, ok := lru.Get("forever"); !ok || lru.Len() != 1 {
+		t.Fatalf("entry without ttl should never expire")
+	}
+}
+
+func TestUpdateKeepsUsedBytes(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key", String("12"))
+	lru.Add("key", String("1234"))
+	if lru.usedBytes != int64(len("key")+len("1234")) {
+		t.Fatalf("used bytes miscounted after update: %d", lru.usedBytes)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	lru := New(int64(0), nil)
+	lru.Add("key1", String("1234"))
+	if !lru.Remove("key1") || lru.Len() != 0 || lru.usedBytes != 0 {
+		t.Fatalf("remove key1 failed")
+	}
+	if lru.Remove("key1") {
+		t.Fatalf("remove a missing key should report false")
+	}
+}
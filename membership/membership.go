@@ -0,0 +1,602 @@
+/*
+Cluster membership with SWIM-style gossip over HTTP.
+
+A node joins by pinging a single seed. From then on, every ProbeInterval
+it pings one member in turn. If the member does not answer, a few other
+members are asked to ping it on our behalf, so that a flaky link between
+two nodes is not mistaken for a dead node. A member that still does not
+answer is suspected, and declared dead after SuspicionTimeout unless it
+refutes the suspicion in the meantime.
+
+Every ping and every answer carries the full member list (the gossip),
+so changes spread through the cluster in a few rounds.
+See "SWIM: Scalable Weakly-consistent Infection-style Process Group
+Membership Protocol", Das et al., 2002.
+*/
+package membership
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the membership API is served
+const DEFAULT_PATH = "/_membership/"
+
+// Defaults of the protocol
+const (
+	DEFAULT_PROBE_INTERVAL    = time.Second
+	DEFAULT_PROBE_TIMEOUT     = 500 * time.Millisecond
+	DEFAULT_INDIRECT_PROBES   = 3
+	DEFAULT_SUSPICION_TIMEOUT = 5 * time.Second
+)
+
+type State int
+
+const (
+	Alive State = iota
+	// did not answer, but may still refute it
+	Suspect
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// What a node knows about another one
+type Member struct {
+	Addr  string `json:"addr"`
+	State State  `json:"state"`
+	// Only the member itself increases it, to refute a suspicion.
+	// Newer information about a member has a higher incarnation
+	Incarnation uint64 `json:"incarnation"`
+}
+
+type Config struct {
+	// must provide the address peers use to reach this node,
+	// e.g. http://localhost:8001, the same as HTTPServerConfig.SelfIP
+	Self string
+	// optional, DEFAULT_PATH by default
+	Path string
+	// optional, see the defaults above
+	ProbeInterval    time.Duration
+	ProbeTimeout     time.Duration
+	IndirectProbes   int
+	SuspicionTimeout time.Duration
+	// optional, called when a member joins or leaves the cluster.
+	// They are called one at a time, in the order of the events
+	OnJoin  func(addr string)
+	OnLeave func(addr string)
+	// optional, the peers to keep in sync with the members, e.g. a
+	// *qecache.HTTPServer. Self is added right away, then every member
+	// is added when it joins and removed when it leaves, before OnJoin
+	// and OnLeave are called
+	Peers Peers
+	// optional, http.DefaultClient by default
+	Client *http.Client
+}
+
+// What follows the membership, so that keys are only placed on members.
+// qecache.HTTPServer implements it
+type Peers interface {
+	AddPeer(addrs ...string)
+	RemovePeer(addrs ...string)
+}
+
+type Memberlist struct {
+	config Config
+	mu     sync.Mutex
+	// everything we know, including ourselves and dead members.
+	// Dead members are kept so that stale gossip can't bring them back
+	members map[string]*Member
+	// when each suspect member became suspect
+	suspectSince map[string]time.Time
+	// the members to probe in this round, in random order
+	probeQueue []string
+	// membership changes waiting for OnJoin and OnLeave.
+	// They are queued with mu held, by the change itself, so that two
+	// merges running at once can't queue them out of order
+	pending []event
+	// wakes up dispatch when events are queued
+	wake chan struct{}
+	stop chan struct{}
+	once sync.Once
+}
+
+type event struct {
+	addr   string
+	joined bool
+}
+
+// the body of both ping and ping-req requests
+type pingRequest struct {
+	From    string   `json:"from"`
+	Members []Member `json:"members"`
+	// only for ping-req: the member to ping on behalf of From
+	Target string `json:"target,omitempty"`
+}
+
+type pingResponse struct {
+	Members []Member `json:"members"`
+}
+
+func New(config Config) *Memberlist {
+	if config.Self == "" {
+		panic("Must provide Self address")
+	}
+	if config.Path == "" {
+		config.Path = DEFAULT_PATH
+	}
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = DEFAULT_PROBE_INTERVAL
+	}
+	if config.ProbeTimeout == 0 {
+		config.ProbeTimeout = DEFAULT_PROBE_TIMEOUT
+	}
+	if config.IndirectProbes == 0 {
+		config.IndirectProbes = DEFAULT_INDIRECT_PROBES
+	}
+	if config.SuspicionTimeout == 0 {
+		config.SuspicionTimeout = DEFAULT_SUSPICION_TIMEOUT
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	m := &Memberlist{
+		config:       config,
+		members:      make(map[string]*Member),
+		suspectSince: make(map[string]time.Time),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+	// Start from the current time rather than 0, so that a restarted
+	// node is newer than whatever the cluster remembers about it
+	m.members[config.Self] = &Member{Addr: config.Self, State: Alive, Incarnation: uint64(time.Now().UnixNano())}
+	if config.Peers != nil {
+		config.Peers.AddPeer(config.Self)
+	}
+
+	go m.dispatch()
+	return m
+}
+
+// The addresses of the members that are alive or suspect, self included,
+// sorted. A suspect is still a member until it is declared dead.
+func (m *Memberlist) Members() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	addrs := make([]string, 0, len(m.members))
+	for addr, member := range m.members {
+		if member.State != Dead {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// What this node knows about a member
+func (m *Memberlist) Member(addr string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if member, ok := m.members[addr]; ok {
+		return *member, true
+	}
+	return Member{}, false
+}
+
+// Join the cluster through any of the seeds.
+// It succeeds as soon as one seed answers
+func (m *Memberlist) Join(seeds ...string) error {
+	var errs []error
+	for _, seed := range seeds {
+		if seed == m.config.Self {
+			continue
+		}
+		if err := m.ping(context.Background(), seed); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return nil
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("cannot join: %w", errors.Join(errs...))
+}
+
+// Start probing members in the background, until Stop
+func (m *Memberlist) Start() {
+	go func() {
+		ticker := time.NewTicker(m.config.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.probeOnce()
+				m.expireSuspects()
+			}
+		}
+	}()
+}
+
+// Stop probing and calling the callbacks
+func (m *Memberlist) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+	})
+}
+
+// call the callbacks one at a time, outside of any lock,
+// so that they may call Members()
+func (m *Memberlist) dispatch() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.wake:
+		}
+
+		m.mu.Lock()
+		events := m.pending
+		m.pending = nil
+		m.mu.Unlock()
+
+		for _, e := range events {
+			if m.config.Peers != nil {
+				if e.joined {
+					m.config.Peers.AddPeer(e.addr)
+				} else {
+					m.config.Peers.RemovePeer(e.addr)
+				}
+			}
+			if e.joined && m.config.OnJoin != nil {
+				m.config.OnJoin(e.addr)
+			}
+			if !e.joined && m.config.OnLeave != nil {
+				m.config.OnLeave(e.addr)
+			}
+		}
+	}
+}
+
+// Queue a join or leave for dispatch, with the lock held
+func (m *Memberlist) emit(e event) {
+	m.pending = append(m.pending, e)
+	// a wake-up already waiting covers this event as well
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ======================================
+// Failure detection
+// ======================================
+
+// Probe the next member. Members are probed in a random round robin,
+// so that each one is probed within a bounded number of rounds
+func (m *Memberlist) probeOnce() {
+	target := m.nextTarget()
+	if target == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.ProbeTimeout)
+	err := m.ping(ctx, target)
+	cancel()
+	if err == nil {
+		return
+	}
+
+	if m.probeIndirectly(target) {
+		return
+	}
+	m.suspect(target)
+}
+
+func (m *Memberlist) nextTarget() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		if len(m.probeQueue) == 0 {
+			for addr, member := range m.members {
+				if addr != m.config.Self && member.State != Dead {
+					m.probeQueue = append(m.probeQueue, addr)
+				}
+			}
+			if len(m.probeQueue) == 0 {
+				return ""
+			}
+			rand.Shuffle(len(m.probeQueue), func(i, j int) {
+				m.probeQueue[i], m.probeQueue[j] = m.probeQueue[j], m.probeQueue[i]
+			})
+		}
+
+		target := m.probeQueue[0]
+		m.probeQueue = m.probeQueue[1:]
+		// it may have died since the queue was built
+		if member, ok := m.members[target]; ok && member.State != Dead {
+			return target
+		}
+	}
+}
+
+// Ask a few other members to ping the target for us.
+// Returns whether any of them reached it
+func (m *Memberlist) probeIndirectly(target string) bool {
+	m.mu.Lock()
+	var helpers []string
+	for addr, member := range m.members {
+		if addr != m.config.Self && addr != target && member.State == Alive {
+			helpers = append(helpers, addr)
+		}
+	}
+	m.mu.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	helpers = helpers[:min(len(helpers), m.config.IndirectProbes)]
+	if len(helpers) == 0 {
+		return false
+	}
+
+	// the helpers need time for their own ping
+	ctx, cancel := context.WithTimeout(context.Background(), 2*m.config.ProbeTimeout)
+	defer cancel()
+
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			acks <- m.pingReq(ctx, helper, target) == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Memberlist) suspect(addr string) {
+	m.mu.Lock()
+	member, ok := m.members[addr]
+	if !ok || member.State != Alive {
+		m.mu.Unlock()
+		return
+	}
+	// the incarnation stays, so that the member can refute with a higher one
+	m.apply(Member{Addr: addr, State: Suspect, Incarnation: member.Incarnation})
+	m.mu.Unlock()
+}
+
+// declare dead the members suspected for too long
+func (m *Memberlist) expireSuspects() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for addr, since := range m.suspectSince {
+		if time.Since(since) >= m.config.SuspicionTimeout {
+			member := m.members[addr]
+			m.apply(Member{Addr: addr, State: Dead, Incarnation: member.Incarnation})
+		}
+	}
+}
+
+// ======================================
+// Gossip
+// ======================================
+
+// Merge what another node knows into what we know.
+func (m *Memberlist) merge(members []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, member := range members {
+		m.apply(member)
+	}
+}
+
+// Apply one piece of news about a member, with the lock held.
+// Queues the join or leave it causes
+func (m *Memberlist) apply(news Member) {
+	if news.Addr == m.config.Self {
+		self := m.members[m.config.Self]
+		// somebody thinks we are in trouble: refute it with a newer incarnation.
+		// The refutation spreads with the next gossip
+		if news.State != Alive && news.Incarnation >= self.Incarnation {
+			self.Incarnation = news.Incarnation + 1
+		}
+		return
+	}
+
+	known, ok := m.members[news.Addr]
+	if !ok {
+		m.members[news.Addr] = &news
+		if news.State == Suspect {
+			m.suspectSince[news.Addr] = time.Now()
+		}
+		if news.State != Dead {
+			m.emit(event{addr: news.Addr, joined: true})
+		}
+		return
+	}
+
+	if !newer(news, *known) {
+		return
+	}
+
+	wasMember := known.State != Dead
+	*known = news
+
+	switch news.State {
+	case Suspect:
+		if _, ok := m.suspectSince[news.Addr]; !ok {
+			m.suspectSince[news.Addr] = time.Now()
+		}
+	default:
+		delete(m.suspectSince, news.Addr)
+	}
+
+	isMember := news.State != Dead
+	switch {
+	case !wasMember && isMember:
+		m.emit(event{addr: news.Addr, joined: true})
+	case wasMember && !isMember:
+		m.emit(event{addr: news.Addr, joined: false})
+	}
+}
+
+// Whether the news overrides what we know.
+// A higher incarnation always wins. For the same incarnation,
+// dead overrides suspect which overrides alive
+func newer(news Member, known Member) bool {
+	if news.Incarnation != known.Incarnation {
+		return news.Incarnation > known.Incarnation
+	}
+	return news.State > known.State
+}
+
+// A member we just heard from directly is alive, whatever the gossip says.
+// It stays at its incarnation, only the member itself may raise it, so
+// gossip of the same suspicion may come back until the member refutes it.
+// A dead member stays dead: it comes back with a newer incarnation
+func (m *Memberlist) heardFrom(addr string) {
+	if addr == "" || addr == m.config.Self {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	known, ok := m.members[addr]
+	switch {
+	case !ok:
+		// its gossip did not even mention itself
+		m.apply(Member{Addr: addr, State: Alive})
+	case known.State == Suspect:
+		known.State = Alive
+		delete(m.suspectSince, addr)
+	}
+}
+
+// Whether addr is a member we may ping on behalf of another one.
+// We only probe members we know of, not any address a request names
+func (m *Memberlist) isMember(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member, ok := m.members[addr]
+	return ok && addr != m.config.Self && member.State != Dead
+}
+
+func (m *Memberlist) snapshot() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, member := range m.members {
+		members = append(members, *member)
+	}
+	return members
+}
+
+// ======================================
+// HTTP
+// ======================================
+
+func (m *Memberlist) ping(ctx context.Context, addr string) error {
+	return m.post(ctx, addr, "ping", pingRequest{From: m.config.Self, Members: m.snapshot()})
+}
+
+func (m *Memberlist) pingReq(ctx context.Context, helper string, target string) error {
+	return m.post(ctx, helper, "ping-req", pingRequest{From: m.config.Self, Members: m.snapshot(), Target: target})
+}
+
+func (m *Memberlist) post(ctx context.Context, addr string, api string, body pingRequest) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+m.config.Path+api, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := m.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", api, addr, res.Status)
+	}
+
+	var answer pingResponse
+	if err := json.NewDecoder(res.Body).Decode(&answer); err != nil {
+		return err
+	}
+	m.merge(answer.Members)
+	m.heardFrom(addr)
+	return nil
+}
+
+// Serve the membership API
+// POST /<path>/ping
+// POST /<path>/ping-req
+func (m *Memberlist) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req pingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	m.merge(req.Members)
+	m.heardFrom(req.From)
+
+	switch strings.TrimPrefix(r.URL.Path, m.config.Path) {
+	case "ping":
+	case "ping-req":
+		if !m.isMember(req.Target) {
+			http.Error(w, "unknown target", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), m.config.ProbeTimeout)
+		defer cancel()
+		if err := m.ping(ctx, req.Target); err != nil {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pingResponse{Members: m.snapshot()})
+}
@@ -0,0 +1,267 @@
+package membership
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	list   *Memberlist
+	server *httptest.Server
+	mu     sync.Mutex
+	left   []string
+}
+
+// start a node on localhost, probing fast so that tests are quick
+func startNode(t *testing.T) *testNode {
+	node := &testNode{}
+	var handler http.Handler
+	node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	node.list = New(Config{
+		Self:             node.server.URL,
+		ProbeInterval:    10 * time.Millisecond,
+		ProbeTimeout:     50 * time.Millisecond,
+		SuspicionTimeout: 100 * time.Millisecond,
+		OnLeave: func(addr string) {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			node.left = append(node.left, addr)
+		},
+	})
+	mux := http.NewServeMux()
+	mux.Handle(DEFAULT_PATH, node.list)
+	handler = mux
+
+	t.Cleanup(func() {
+		node.list.Stop()
+		node.server.Close()
+	})
+	return node
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJoinAndLeave(t *testing.T) {
+	nodes := []*testNode{startNode(t), startNode(t), startNode(t)}
+	seed := nodes[0].server.URL
+
+	var addrs []string
+	for _, node := range nodes {
+		addrs = append(addrs, node.server.URL)
+		if err := node.list.Join(seed); err != nil {
+			t.Fatal(err)
+		}
+		node.list.Start()
+	}
+	sort.Strings(addrs)
+
+	// each node only knows the seed, gossip tells them about each other
+	for _, node := range nodes {
+		waitFor(t, "everybody to join", func() bool {
+			return reflect.DeepEqual(node.list.Members(), addrs)
+		})
+	}
+
+	// the last node crashes
+	dead := nodes[2]
+	dead.list.Stop()
+	dead.server.Close()
+
+	alive := []string{nodes[0].server.URL, nodes[1].server.URL}
+	sort.Strings(alive)
+	for _, node := range nodes[:2] {
+		waitFor(t, "the dead node to leave", func() bool {
+			return reflect.DeepEqual(node.list.Members(), alive)
+		})
+		waitFor(t, "OnLeave", func() bool {
+			node.mu.Lock()
+			defer node.mu.Unlock()
+			return reflect.DeepEqual(node.left, []string{dead.server.URL})
+		})
+	}
+}
+
+func TestJoinWithoutSeed(t *testing.T) {
+	node := startNode(t)
+	if err := node.list.Join("http://127.0.0.1:1"); err == nil {
+		t.Fatalf("joined through a seed that does not exist")
+	}
+}
+
+func TestRefute(t *testing.T) {
+	node := startNode(t)
+	self, _ := node.list.Member(node.list.config.Self)
+
+	// gossip claims we are suspect
+	node.list.merge([]Member{{Addr: self.Addr, State: Suspect, Incarnation: self.Incarnation}})
+
+	now, _ := node.list.Member(self.Addr)
+	if now.State != Alive || now.Incarnation <= self.Incarnation {
+		t.Fatalf("suspicion not refuted: %+v", now)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	node := startNode(t)
+	m := node.list
+
+	m.merge([]Member{{Addr: "a", State: Alive, Incarnation: 1}})
+	// same incarnation, the worse state wins
+	m.merge([]Member{{Addr: "a", State: Suspect, Incarnation: 1}})
+	if member, _ := m.Member("a"); member.State != Suspect {
+		t.Fatalf("want suspect, got %v", member.State)
+	}
+	// stale news are ignored
+	m.merge([]Member{{Addr: "a", State: Alive, Incarnation: 0}})
+	if member, _ := m.Member("a"); member.State != Suspect {
+		t.Fatalf("want suspect, got %v", member.State)
+	}
+	// a refutation clears the suspicion
+	m.merge([]Member{{Addr: "a", State: Alive, Incarnation: 2}})
+	if member, _ := m.Member("a"); member.State != Alive {
+		t.Fatalf("want alive, got %v", member.State)
+	}
+}
+
+// records what the memberlist tells the ring
+type fakePeers struct {
+	mu    sync.Mutex
+	addrs map[string]bool
+}
+
+func (p *fakePeers) AddPeer(addrs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, addr := range addrs {
+		p.addrs[addr] = true
+	}
+}
+
+func (p *fakePeers) RemovePeer(addrs ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, addr := range addrs {
+		delete(p.addrs, addr)
+	}
+}
+
+func (p *fakePeers) list() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var addrs []string
+	for addr := range p.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestPeersFollowMembers(t *testing.T) {
+	node := startNode(t)
+	peers := &fakePeers{addrs: map[string]bool{}}
+	m := New(Config{Self: "self", Peers: peers})
+	t.Cleanup(m.Stop)
+
+	if got := peers.list(); !reflect.DeepEqual(got, []string{"self"}) {
+		t.Fatalf("self should be a peer right away, got %v", got)
+	}
+
+	if err := m.Join(node.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{node.server.URL, "self"}
+	sort.Strings(want)
+	waitFor(t, "the seed to be a peer", func() bool {
+		return reflect.DeepEqual(peers.list(), want)
+	})
+
+	member, _ := m.Member(node.server.URL)
+	m.merge([]Member{{Addr: node.server.URL, State: Dead, Incarnation: member.Incarnation}})
+	waitFor(t, "the dead member to leave the peers", func() bool {
+		return reflect.DeepEqual(peers.list(), []string{"self"})
+	})
+}
+
+func TestPingClearsSuspicion(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	if err := a.list.Join(b.server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// b suspects a, then a pings b
+	member, _ := b.list.Member(a.server.URL)
+	b.list.suspect(a.server.URL)
+	if now, _ := b.list.Member(a.server.URL); now.State != Suspect {
+		t.Fatalf("want suspect, got %v", now.State)
+	}
+	// a's own gossip still has the same incarnation, the ping alone clears it
+	if err := a.list.ping(context.Background(), b.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if now, _ := b.list.Member(a.server.URL); now.State != Alive || now.Incarnation != member.Incarnation {
+		t.Fatalf("whoever pings us is alive, got %+v", now)
+	}
+}
+
+func TestPingReqUnknownTarget(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	if err := a.list.Join(b.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.list.pingReq(context.Background(), b.server.URL, "http://example.com"); err == nil {
+		t.Fatalf("ping-req should only probe members")
+	}
+	if err := a.list.pingReq(context.Background(), b.server.URL, a.server.URL); err != nil {
+		t.Fatalf("ping-req of a member failed: %v", err)
+	}
+}
+
+func TestConcurrentMergesKeepOrder(t *testing.T) {
+	peers := &fakePeers{addrs: map[string]bool{}}
+	m := New(Config{Self: "self", Peers: peers})
+	t.Cleanup(m.Stop)
+
+	// the same member joins and leaves over and over, from many
+	// gossip handlers at once
+	var wg sync.WaitGroup
+	for i := 1; i <= 500; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state := Alive
+			if i%2 == 1 {
+				state = Dead
+			}
+			m.merge([]Member{{Addr: "a", State: state, Incarnation: uint64(i)}})
+		}()
+	}
+	wg.Wait()
+
+	// whatever the last news, the ring must end up agreeing with it
+	want := []string{"self"}
+	if member, _ := m.Member("a"); member.State != Dead {
+		want = []string{"a", "self"}
+	}
+	waitFor(t, "the ring to follow the members", func() bool {
+		return reflect.DeepEqual(peers.list(), want)
+	})
+	if got := m.Members(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("members %v, want %v", got, want)
+	}
+}
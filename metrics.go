@@ -0,0 +1,161 @@
+// Expose the statistics in the Prometheus text exposition format.
+// We write the format by hand, it is simple enough and saves a dependency.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+package qecache
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds (in seconds) of the buckets of the peer latency histograms
+var LATENCY_BUCKETS = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A cumulative histogram, like the one of Prometheus
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts[i] counts the observations <= bounds[i],
+	// the last one counts those above every bound
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// all the controllers, sorted by name so that the output is stable
+func listControllers() []*Controller {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]*Controller, 0, len(controllers))
+	for _, c := range controllers {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// one metric of a controller, read from a Stats snapshot
+type controllerMetric struct {
+	name string
+	help string
+	read func(Stats) int64
+}
+
+var controllerMetrics = []controllerMetric{
+	{"qecache_gets_total", "Get requests, including those from peers.", func(s Stats) int64 { return s.Gets }},
+	{"qecache_hits_total", "Get requests served by either cache.", func(s Stats) int64 { return s.CacheHits }},
+	{"qecache_loads_total", "Get requests that missed both caches.", func(s Stats) int64 { return s.Loads }},
+	{"qecache_loads_deduped_total", "Loads that joined a load of the same key already in flight.", func(s Stats) int64 { return s.LoadsDeduped }},
+	{"qecache_peer_loads_total", "Values received from peers.", func(s Stats) int64 { return s.PeerLoads }},
+	{"qecache_peer_errors_total", "Failures to get a value from peers.", func(s Stats) int64 { return s.PeerErrors }},
+	{"qecache_local_loads_total", "Values loaded by the fetcher.", func(s Stats) int64 { return s.LocalLoads }},
+	{"qecache_local_load_errors_total", "Failures of the fetcher.", func(s Stats) int64 { return s.LocalLoadErrs }},
+	{"qecache_loads_shed_total", "Loads given up because the fetcher was over its limits.", func(s Stats) int64 { return s.LoadsShed }},
+	{"qecache_stale_hits_total", "Cache hits that served a value past its expiration.", func(s Stats) int64 { return s.StaleHits }},
+	{"qecache_refreshes_total", "Values refreshed in the background.", func(s Stats) int64 { return s.Refreshes }},
+}
+
+// one metric of a cache, read from a CacheStats snapshot
+type cacheMetric struct {
+	name string
+	kind string
+	help string
+	read func(CacheStats) int64
+}
+
+var cacheMetrics = []cacheMetric{
+	{"qecache_cache_bytes", "gauge", "Bytes taken by the keys and values.", func(s CacheStats) int64 { return s.Bytes }},
+	{"qecache_cache_items", "gauge", "Entries in the cache.", func(s CacheStats) int64 { return s.Items }},
+	{"qecache_cache_gets_total", "counter", "Lookups in the cache.", func(s CacheStats) int64 { return s.Gets }},
+	{"qecache_cache_hits_total", "counter", "Lookups that found the key.", func(s CacheStats) int64 { return s.Hits }},
+	{"qecache_cache_evictions_total", "counter", "Entries evicted or expired.", func(s CacheStats) int64 { return s.Evictions }},
+}
+
+// Write the metrics of every controller, and the latency of each peer
+func writeMetrics(w io.Writer, peerLatency map[string]*histogram) {
+	list := listControllers()
+
+	stats := make([]Stats, len(list))
+	mainStats := make([]CacheStats, len(list))
+	hotStats := make([]CacheStats, len(list))
+	for i, c := range list {
+		stats[i] = c.Stats()
+		mainStats[i] = c.CacheStats(MainCache)
+		hotStats[i] = c.CacheStats(HotCache)
+	}
+
+	for _, m := range controllerMetrics {
+		writeHeader(w, m.name, "counter", m.help)
+		for i, c := range list {
+			fmt.Fprintf(w, "%s{controller=\"%s\"} %d\n", m.name, escapeLabel(c.name), m.read(stats[i]))
+		}
+	}
+
+	for _, m := range cacheMetrics {
+		writeHeader(w, m.name, m.kind, m.help)
+		for i, c := range list {
+			fmt.Fprintf(w, "%s{controller=\"%s\",cache=\"main\"} %d\n", m.name, escapeLabel(c.name), m.read(mainStats[i]))
+			fmt.Fprintf(w, "%s{controller=\"%s\",cache=\"hot\"} %d\n", m.name, escapeLabel(c.name), m.read(hotStats[i]))
+		}
+	}
+
+	peers := make([]string, 0, len(peerLatency))
+	for peer := range peerLatency {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	const name = "qecache_peer_request_duration_seconds"
+	writeHeader(w, name, "histogram", "Latency of requests to peers.")
+	for _, peer := range peers {
+		writeHistogram(w, name, fmt.Sprintf("peer=\"%s\"", escapeLabel(peer)), peerLatency[peer])
+	}
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(w io.Writer, name string, labels string, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// buckets of Prometheus are cumulative
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
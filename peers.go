@@ -1,11 +1,96 @@
 // Get entry from peers
 package qecache
 
+import "context"
+
 // Keep records of peers in this dictionary
 type PeerDict interface {
 	PeerOfKey(key string) (peer RemotePeer, ok bool)
 }
 
+// A PeerDict that knows every peer in the cluster.
+// Implement it to allow broadcasting invalidations.
+type PeerLister interface {
+	// all the peers except the current node
+	AllPeers() []RemotePeer
+}
+
+// A PeerDict that keeps each key on several nodes, the replicas.
+// Implement it so that a key survives the loss of its owner.
+type ReplicaPeerDict interface {
+	PeerDict
+	// The owners of the key, primary first, without the current node.
+	// self is the position the current node would have among them,
+	// -1 when it is not an owner
+	OwnersOfKey(key string) (peers []RemotePeer, self int)
+}
+
+// A PeerDict that names a stand-in for the owners of a key when none
+// of them answers. Every node must name the same one, e.g. the next node
+// on the ring, so that the key is loaded once for the whole cluster
+// rather than once by every node that asked.
+type FallbackPeerDict interface {
+	// ok is false when the stand-in is the current node, or unknown.
+	// The current node loads the key itself then
+	FallbackOfKey(key string) (peer RemotePeer, ok bool)
+}
+
+// A PeerDict whose placement balances the loads of the nodes, e.g.
+// consistenthash.Bounded. It sees the requests sent to the peers, but
+// the keys the current node loads itself never leave it: the controller
+// reports them here, or the current node would always look idle.
+type LoadTrackingPeerDict interface {
+	// the current node starts loading from the source.
+	// Call done once the load is over
+	LocalLoad() (done func())
+}
+
 type RemotePeer interface {
 	Get(namespace string, key string) ([]byte, error)
 }
+
+// The peers may do more than Get. The controller checks which of the
+// interfaces below a peer implements, like it does for fetchers, so a
+// plain RemotePeer keeps working: the features it lacks are emulated
+// with Get, or reported as errors.ErrUnsupported.
+
+// A RemotePeer that stops waiting when ctx is done
+type RemotePeerContext interface {
+	GetContext(ctx context.Context, namespace string, key string) ([]byte, error)
+}
+
+// A RemotePeer that also tells when the value expires, if it knows.
+// Preferred over GetContext
+type LookupPeer interface {
+	Lookup(ctx context.Context, namespace string, key string) (ByteView, error)
+}
+
+// A RemotePeer that can drop keys, needed by Controller.Remove
+type RemovablePeer interface {
+	// drop the key from the peer's local cache only.
+	// The peer must not forward it further
+	Remove(namespace string, key string) error
+}
+
+// A RemotePeer that can store keys, needed by Controller.Set
+type WritablePeer interface {
+	// store the value in the peer's local cache only, as one of the
+	// owners of the key. The peer must not forward it further
+	Set(namespace string, key string, value ByteView) error
+}
+
+// A RemotePeer that looks up many keys in a single request, see
+// Controller.GetMulti. Other peers are asked key by key
+type BatchPeer interface {
+	// The results are in the same order as the keys. The error is for
+	// the request as a whole, e.g. the peer can't be reached.
+	// An error wrapping errors.ErrUnsupported tells the peer can't answer
+	// batches, e.g. it runs an older version: it is asked key by key
+	LookupMulti(ctx context.Context, namespace string, keys []string) ([]LookupResult, error)
+}
+
+// The outcome of the lookup of one key among many
+type LookupResult struct {
+	Value ByteView
+	Err   error
+}
@@ -0,0 +1,58 @@
+// The eviction policies that a controller can choose from.
+// Pass one of them to WithEvictionPolicy
+package qecache
+
+import (
+	"QECache/arc"
+	"QECache/eviction"
+	"QECache/lfu"
+	"QECache/lru"
+	"QECache/tinylfu"
+	"QECache/twoq"
+)
+
+// The functions below all implement eviction.Factory.
+// Each package returns its own concrete type, so we wrap them
+// in order to return the interface.
+
+// Least recently used. The default
+func LRU(maxBytes int64, onEvicted func(string, eviction.Value)) eviction.Policy {
+	return lru.New(maxBytes, onEvicted)
+}
+
+// Least frequently used
+func LFU(maxBytes int64, onEvicted func(string, eviction.Value)) eviction.Policy {
+	return lfu.New(maxBytes, onEvicted)
+}
+
+// Adaptive replacement cache, balancing recency and frequency by itself
+func ARC(maxBytes int64, onEvicted func(string, eviction.Value)) eviction.Policy {
+	return arc.New(maxBytes, onEvicted)
+}
+
+// 2Q, resistant to scans
+func TwoQ(maxBytes int64, onEvicted func(string, eviction.Value)) eviction.Policy {
+	return twoq.New(maxBytes, onEvicted)
+}
+
+// Window TinyLFU, admits new entries based on their popularity
+func TinyLFU(maxBytes int64, onEvicted func(string, eviction.Value)) eviction.Policy {
+	return tinylfu.New(maxBytes, onEvicted)
+}
+
+// Every policy above by name, e.g. to pick one from a command line flag.
+// A new policy belongs here too: the eviction tests run over this map
+var EvictionPolicies = map[string]eviction.Factory{
+	"lru":     LRU,
+	"lfu":     LFU,
+	"arc":     ARC,
+	"2q":      TwoQ,
+	"tinylfu": TinyLFU,
+}
+
+// assert they are all factories
+var _ eviction.Factory = LRU
+var _ eviction.Factory = LFU
+var _ eviction.Factory = ARC
+var _ eviction.Factory = TwoQ
+var _ eviction.Factory = TinyLFU
@@ -1,10 +1,20 @@
 package qecache
 
 import (
+	"QECache/eviction"
+	"QECache/singleflight"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestGetter(t *testing.T) {
@@ -55,3 +65,383 @@ func TestGet(t *testing.T) {
 		t.Fatalf("the value of unknow should be empty, but %s got", view)
 	}
 }
+
+func TestGetWithTTL(t *testing.T) {
+	loads := 0
+	fetch := TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		loads++
+		return []byte(key), 20 * time.Millisecond, nil
+	})
+
+	gee := NewController("ttl", 2<<10, fetch)
+
+	if _, err := gee.Get("Tom"); err != nil || loads != 1 {
+		t.Fatalf("first get should load, loads %d", loads)
+	}
+	if _, err := gee.Get("Tom"); err != nil || loads != 1 {
+		t.Fatalf("second get should hit, loads %d", loads)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" || loads != 2 {
+		t.Fatalf("expired value should be loaded again, loads %d", loads)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	loads := 0
+	fetch := FetcherFunc(func(key string) ([]byte, error) {
+		loads++
+		if key == "flaky" {
+			return nil, fmt.Errorf("connection reset")
+		}
+		return nil, fmt.Errorf("%s not exist: %w", key, ErrNotFound)
+	})
+
+	gee := NewController("negative", 2<<10, fetch, WithNegativeTTL(20*time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		if _, err := gee.Get("Tom"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expect not found, got %v", err)
+		}
+	}
+	if loads != 1 {
+		t.Fatalf("a missing key should be remembered, loads %d", loads)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	gee.Get("Tom")
+	if loads != 2 {
+		t.Fatalf("a missing key should be forgotten after the ttl, loads %d", loads)
+	}
+
+	// other errors may be transient, they are never cached
+	gee.Get("flaky")
+	if _, err := gee.Get("flaky"); err == nil || errors.Is(err, ErrNotFound) || loads != 4 {
+		t.Fatalf("transient errors should not be cached, loads %d, err %v", loads, err)
+	}
+
+	// disabled by default
+	plain := NewController("no-negative", 2<<10, fetch)
+	plain.Get("Tom")
+	plain.Get("Tom")
+	if loads != 6 {
+		t.Fatalf("negative caching should be opt-in, loads %d", loads)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	fetch := TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		n := loads.Add(1)
+		if n > 1 {
+			// a slow source, nobody should wait for it
+			<-release
+		}
+		return []byte(fmt.Sprintf("%s-%d", key, n)), 20 * time.Millisecond, nil
+	})
+
+	gee := NewController("stale", 2<<10, fetch, WithStaleWhileRevalidate(time.Second))
+	gee.Get("Tom")
+	time.Sleep(40 * time.Millisecond)
+
+	// the expired value is served at once, and refreshed once
+	for i := 0; i < 3; i++ {
+		if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom-1" {
+			t.Fatalf("expect the stale value, got %v %v", view, err)
+		}
+	}
+	close(release)
+	waitUntil(t, func() bool {
+		view, _ := gee.Get("Tom")
+		return view.String() == "Tom-2"
+	})
+	if loads.Load() != 2 {
+		t.Fatalf("a key should be refreshed once at a time, loads %d", loads.Load())
+	}
+	if stats := gee.Stats(); stats.StaleHits < 3 || stats.Refreshes != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// past the window it is gone, the caller waits for the load
+	plain := NewController("no-stale", 2<<10, TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		return []byte(key), 20 * time.Millisecond, nil
+	}))
+	plain.Get("Tom")
+	time.Sleep(40 * time.Millisecond)
+	plain.Get("Tom")
+	if stats := plain.Stats(); stats.StaleHits != 0 || stats.Loads != 2 {
+		t.Fatalf("stale values should be opt-in, stats %+v", stats)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	var loads atomic.Int32
+	fetch := TTLFetcherFunc(func(key string) ([]byte, time.Duration, error) {
+		loads.Add(1)
+		return []byte(key), 100 * time.Millisecond, nil
+	})
+
+	gee := NewController("refresh-ahead", 2<<10, fetch, WithRefreshAhead(50*time.Millisecond))
+	view, _ := gee.Get("Tom")
+	gee.Get("Tom")
+	if loads.Load() != 1 {
+		t.Fatalf("a fresh value should not be refreshed, loads %d", loads.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, err := gee.Get("Tom"); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool {
+		refreshed, _ := gee.Get("Tom")
+		return refreshed.Expire().After(view.Expire())
+	})
+	if loads.Load() != 2 {
+		t.Fatalf("expect one refresh, loads %d", loads.Load())
+	}
+}
+
+// Poll cond, since background work has no completion signal
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	var fetched [][]string
+	gee := NewController("multi", 2<<10, BatchFetcherFunc(
+		func(ctx context.Context, keys []string) (map[string][]byte, time.Duration, error) {
+			fetched = append(fetched, keys)
+			values := make(map[string][]byte)
+			for _, key := range keys {
+				if key == "broken" {
+					return nil, 0, fmt.Errorf("connection reset")
+				}
+				if key != "unknown" {
+					values[key] = []byte(key)
+				}
+			}
+			return values, 0, nil
+		}), WithNegativeTTL(time.Minute))
+
+	gee.Get("Tom")
+	values, err := gee.GetMulti([]string{"Tom", "Jack", "unknown", "Jack"})
+	if err != nil || len(values) != 2 || values["Tom"].String() != "Tom" || values["Jack"].String() != "Jack" {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+	// cached keys and duplicates are not fetched again
+	if !reflect.DeepEqual(fetched, [][]string{{"Tom"}, {"Jack", "unknown"}}) {
+		t.Fatalf("expect a single batch of the misses, fetched %v", fetched)
+	}
+	gee.GetMulti([]string{"Jack", "unknown"})
+	if len(fetched) != 2 {
+		t.Fatalf("the batch should populate the caches, fetched %v", fetched)
+	}
+
+	// a failed batch fails all its keys, the others are still returned
+	values, err = gee.GetMulti([]string{"Tom", "broken", "Sam"})
+	if err == nil || !strings.Contains(err.Error(), `key "broken": connection reset`) || len(values) != 1 {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+
+	// a plain fetcher loads the keys one by one
+	plain := NewController("multi-plain", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	if values, err := plain.GetMulti([]string{"Tom", "Jack"}); err != nil || len(values) != 2 {
+		t.Fatalf("unexpected result %v, %v", values, err)
+	}
+	if stats := plain.Stats(); stats.Gets != 2 || stats.LocalLoads != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestClose(t *testing.T) {
+	gee := NewController("close", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithSweepInterval(time.Millisecond))
+	gee.Close()
+	// twice is fine, and lookups still work
+	gee.Close()
+	if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" {
+		t.Fatalf("a closed controller should still serve lookups, got %v %v", view, err)
+	}
+}
+
+func TestHotCache(t *testing.T) {
+	gee := NewController("hot", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithHotCacheSampling(1))
+	owner := &fakePeer{}
+	gee.RegisterPeers(&fakePeerDict{owner: owner})
+
+	for i := 0; i < 3; i++ {
+		if view, err := gee.Get("Tom"); err != nil || view.String() != "remote Tom" {
+			t.Fatalf("unexpected value %s", view)
+		}
+	}
+	if owner.gets != 1 {
+		t.Fatalf("hot key should be served from hot cache, peer gets %d", owner.gets)
+	}
+
+	gee.Remove("Tom")
+	gee.Get("Tom")
+	if owner.gets != 2 {
+		t.Fatalf("removed key should be dropped from hot cache, peer gets %d", owner.gets)
+	}
+}
+
+func TestSharedBudget(t *testing.T) {
+	gee := NewController("budget", 64, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte("0123456789"), nil
+	}), WithHotCacheSampling(1))
+	gee.RegisterPeers(&fakePeerDict{owner: &fakePeer{}, local: map[string]bool{
+		"a": true, "b": true, "c": true, "d": true, "e": true,
+	}})
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "remote1", "remote2"} {
+		gee.Get(key)
+	}
+	if total := gee.mainCache.bytes() + gee.hotCache.bytes(); total > 64 {
+		t.Fatalf("caches exceed the shared budget: %d", total)
+	}
+	if gee.hotCache.bytes() > 64/HOT_CACHE_RATIO {
+		t.Fatalf("hot cache exceeds its share: %d", gee.hotCache.bytes())
+	}
+}
+
+func TestGetContext(t *testing.T) {
+	gee := NewController("context", 2<<10, FetcherContextFunc(
+		func(ctx context.Context, key string) ([]byte, time.Duration, error) {
+			// a slow db that only gives up when asked to
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := gee.GetContext(ctx, "Tom"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	owner := &fakePeer{}
+	remote := NewController("context-peer", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}))
+	remote.RegisterPeers(&fakePeerDict{owner: owner})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := remote.GetContext(cancelled, "Tom"); owner.gets != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled context should stop the load, peer gets %d, err %v", owner.gets, err)
+	}
+}
+
+func TestFetcherPanic(t *testing.T) {
+	gee := NewController("panic", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		panic("boom")
+	}))
+	var panicErr *singleflight.PanicError
+	if _, err := gee.Get("Tom"); !errors.As(err, &panicErr) {
+		t.Fatalf("a panic of the fetcher should be an error, got %v", err)
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for name, policy := range map[string]eviction.Factory{
+		"lru": LRU, "lfu": LFU, "arc": ARC, "2q": TwoQ, "tinylfu": TinyLFU,
+	} {
+		loads := 0
+		gee := NewController("policy-"+name, 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+			loads++
+			return []byte(key), nil
+		}), WithEvictionPolicy(policy))
+
+		for i := 0; i < 2; i++ {
+			if view, err := gee.Get("Tom"); err != nil || view.String() != "Tom" {
+				t.Fatalf("%s: failed to get Tom", name)
+			}
+		}
+		if loads != 1 {
+			t.Fatalf("%s: second get should hit, loads %d", name, loads)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	gee := NewController("stats", 20, FetcherFunc(func(key string) ([]byte, error) {
+		if key == "unknown" {
+			return nil, fmt.Errorf("%s not exist", key)
+		}
+		return []byte("12345"), nil
+	}))
+
+	gee.Get("Tom")
+	gee.Get("Tom")
+	gee.Get("unknown")
+	// evicts Tom
+	gee.Get("Jack")
+	gee.Get("Sam")
+
+	expect := Stats{Gets: 5, CacheHits: 1, Loads: 4, LocalLoads: 3, LocalLoadErrs: 1}
+	if stats := gee.Stats(); stats != expect {
+		t.Fatalf("expect stats %+v, got %+v", expect, stats)
+	}
+
+	// concurrent gets of the same key share a single load
+	release := make(chan struct{})
+	slow := NewController("stats-dedup", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		<-release
+		return []byte(key), nil
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slow.Get("Tom")
+		}()
+	}
+	// let them all reach singleflight before the load ends
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if stats := slow.Stats(); stats.Loads != 3 || stats.LoadsDeduped != 2 || stats.LocalLoads != 1 {
+		t.Fatalf("expect 2 loads saved by singleflight, got %+v", stats)
+	}
+
+	expectCache := CacheStats{Bytes: 17, Items: 2, Gets: 5, Hits: 1, Evictions: 1}
+	if stats := gee.CacheStats(MainCache); stats != expectCache {
+		t.Fatalf("expect cache stats %+v, got %+v", expectCache, stats)
+	}
+
+	gee.Remove("Sam")
+	if stats := gee.CacheStats(MainCache); stats.Evictions != 1 || stats.Items != 1 {
+		t.Fatalf("explicit removal should not count as eviction: %+v", stats)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	gee := NewController("logger", 2<<10, FetcherFunc(func(key string) ([]byte, error) {
+		return []byte(key), nil
+	}), WithLogger(logger))
+
+	gee.Get("Tom")
+	gee.Get("Tom")
+
+	out := buf.String()
+	for _, s := range []string{"msg=fetched controller=logger key=Tom", "msg=\"cache hit\" controller=logger key=Tom"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("log should contain %q, got\n%s", s, out)
+		}
+	}
+}
@@ -5,7 +5,34 @@ the same key, only one of those goroutines actually goes to fetch the data.
 */
 package singleflight
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// What the waiters get when fn called runtime.Goexit
+var ErrGoexit = errors.New("runtime.Goexit was called")
+
+// What the waiters get when fn panicked.
+// The value and the stack trace of the panic are kept for debugging
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("singleflight: fn panicked: %v\n\n%s", e.Value, e.Stack)
+}
+
+// The outcome of a call, for DoChan
+type Result struct {
+	Val interface{}
+	Err error
+	// whether the result was given to more than one caller
+	Shared bool
+}
 
 // A task that is current ongoing
 // or is finished
@@ -16,6 +43,10 @@ type promise struct {
 	val interface{}
 	// if the task results in an error
 	err error
+	// how many callers joined the first one
+	dups int
+	// where the callers of DoChan wait
+	chans []chan<- Result
 }
 
 type Group struct {
@@ -23,6 +54,11 @@ type Group struct {
 	keyPromiseDict map[string]*promise
 }
 
+// Call fn once for all the concurrent callers with the same key,
+// and give them all its result.
+// If fn panics, the caller running it panics with a *PanicError, while
+// the other callers get that *PanicError as an error. If fn calls
+// runtime.Goexit, they get ErrGoexit.
 func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
 	g.mu.Lock()
 
@@ -31,14 +67,13 @@ func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, err
 	}
 
 	if p, ok := g.keyPromiseDict[key]; ok {
+		p.dups++
 		g.mu.Unlock()
 		// if there is ready a task for this key, wait until it finishes
 		// this is the main idea for the singleflight, very simple
-		// However, we havn't consider to limit the overall request number
-		// external data source. Therefore, we still cannot guarantee that
-		// there is no huge amount of requests being sent in a short period
-		// of time.
-		// TODO: apply overall limitation
+		// It does not limit the overall number of requests to the
+		// external data source, different keys still go through at once.
+		// The controller does, see qecache.WithMaxConcurrentFetches
 		p.wg.Wait()
 		// then we returns whatever has been fetched by that goroutine
 		return p.val, p.err
@@ -50,16 +85,95 @@ func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, err
 	g.keyPromiseDict[key] = p
 	// allow other tasks for other keys to begin
 	g.mu.Unlock()
-	// this is a very useful shortcut
-	p.val, p.err = fn()
 
-	// eq to wg.Add(-1)
-	p.wg.Done()
+	g.call(p, key, fn)
+	// the waiters got an error, but the panic belongs to this goroutine
+	if e, ok := p.err.(*PanicError); ok {
+		panic(e)
+	}
+	return p.val, p.err
+}
 
+// Same as Do, but does not wait: the result is sent to the channel.
+// fn runs in a new goroutine, so a panic can't reach the caller.
+// It is sent as a *PanicError instead
+func (g *Group) DoChan(key string, fn func() (interface{}, error)) <-chan Result {
+	// buffered, so that nothing blocks if the caller stops listening
+	ch := make(chan Result, 1)
+	g.mu.Lock()
+
+	if g.keyPromiseDict == nil {
+		g.keyPromiseDict = make(map[string]*promise)
+	}
+
+	if p, ok := g.keyPromiseDict[key]; ok {
+		p.dups++
+		p.chans = append(p.chans, ch)
+		g.mu.Unlock()
+		return ch
+	}
+
+	p := &promise{chans: []chan<- Result{ch}}
+	p.wg.Add(1)
+	g.keyPromiseDict[key] = p
+	g.mu.Unlock()
+
+	go g.call(p, key, fn)
+	return ch
+}
+
+// Tell the group to forget about a key. The next call for it runs fn
+// again rather than waiting for the current one, e.g. because the
+// current one is known to return a stale value.
+// The callers already waiting still get the result of the current call
+func (g *Group) Forget(key string) {
 	g.mu.Lock()
-	// we can do this because other tasks already get the ref to p
 	delete(g.keyPromiseDict, key)
 	g.mu.Unlock()
+}
 
-	return p.val, p.err
+// Run fn and hand its result to every caller.
+// Whatever happens to fn, the waiters must be released, or they would
+// wait forever
+func (g *Group) call(p *promise, key string, fn func() (interface{}, error)) {
+	returned := false
+	recovered := false
+
+	// runs last, even when fn calls runtime.Goexit.
+	// Goexit can't be stopped, it goes on after this
+	defer func() {
+		if !returned && !recovered {
+			p.err = ErrGoexit
+		}
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		// eq to wg.Add(-1)
+		p.wg.Done()
+		// we can do this because other tasks already get the ref to p.
+		// After a Forget, the key may belong to a newer call
+		if g.keyPromiseDict[key] == p {
+			delete(g.keyPromiseDict, key)
+		}
+		for _, ch := range p.chans {
+			ch <- Result{Val: p.val, Err: p.err, Shared: p.dups > 0}
+		}
+	}()
+
+	func() {
+		defer func() {
+			if returned {
+				return
+			}
+			// recover returns nil on Goexit, there is nothing to recover
+			if r := recover(); r != nil {
+				p.err = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+		}()
+		// this is a very useful shortcut
+		p.val, p.err = fn()
+		returned = true
+	}()
+	// only reached after a return or a recovered panic
+	recovered = !returned
 }
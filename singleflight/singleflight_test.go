@@ -0,0 +1,163 @@
+package singleflight
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	var g Group
+	v, err := g.Do("key", func() (interface{}, error) {
+		return "bar", nil
+	})
+	if v != "bar" || err != nil {
+		t.Fatalf("Do = %v, %v", v, err)
+	}
+}
+
+func TestDoDupSuppress(t *testing.T) {
+	var g Group
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		calls.Add(1)
+		<-release
+		return "bar", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, _ := g.Do("key", fn); v != "bar" {
+				t.Errorf("Do = %v", v)
+			}
+		}()
+	}
+	// let them all join the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("fn called %d times", n)
+	}
+}
+
+func TestDoChan(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		<-release
+		return "bar", nil
+	}
+
+	first := g.DoChan("key", fn)
+	second := g.DoChan("key", fn)
+	close(release)
+
+	for _, ch := range []<-chan Result{first, second} {
+		res := <-ch
+		if res.Val != "bar" || res.Err != nil || !res.Shared {
+			t.Fatalf("unexpected result %+v", res)
+		}
+	}
+
+	res := <-g.DoChan("alone", func() (interface{}, error) { return 1, nil })
+	if res.Shared {
+		t.Fatalf("a single caller should not be shared")
+	}
+}
+
+func TestForget(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	first := g.DoChan("key", func() (interface{}, error) {
+		<-release
+		return "stale", nil
+	})
+
+	g.Forget("key")
+	// a new call instead of joining the first one
+	second := g.DoChan("key", func() (interface{}, error) {
+		return "fresh", nil
+	})
+	if res := <-second; res.Val != "fresh" {
+		t.Fatalf("Forget should start a new call, got %v", res.Val)
+	}
+
+	close(release)
+	if res := <-first; res.Val != "stale" {
+		t.Fatalf("the first call should still complete, got %v", res.Val)
+	}
+	// the first call must not remove the key of another one
+	third := g.DoChan("key", func() (interface{}, error) { return "third", nil })
+	if res := <-third; res.Val != "third" {
+		t.Fatalf("got %v", res.Val)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	var g Group
+	release := make(chan struct{})
+	waiter := make(chan error)
+
+	go func() {
+		defer func() {
+			// the caller running fn panics
+			if r := recover(); r == nil {
+				t.Errorf("the panic should reach the caller")
+			}
+		}()
+		g.Do("key", func() (interface{}, error) {
+			<-release
+			panic("boom")
+		})
+	}()
+
+	// wait for the call to start, then join it
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, err := g.Do("key", func() (interface{}, error) { return nil, nil })
+		waiter <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waiter:
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "boom" {
+			t.Fatalf("the waiter should get the panic as an error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the waiter hangs")
+	}
+
+	res := <-g.DoChan("chan", func() (interface{}, error) { panic("boom") })
+	if _, ok := res.Err.(*PanicError); !ok {
+		t.Fatalf("DoChan should get the panic as an error, got %v", res.Err)
+	}
+}
+
+func TestGoexit(t *testing.T) {
+	var g Group
+	res := <-g.DoChan("key", func() (interface{}, error) {
+		runtime.Goexit()
+		return nil, nil
+	})
+	if res.Err != ErrGoexit {
+		t.Fatalf("expect ErrGoexit, got %v", res.Err)
+	}
+
+	// the key is released
+	v, err := g.Do("key", func() (interface{}, error) { return "bar", nil })
+	if v != "bar" || err != nil {
+		t.Fatalf("Do = %v, %v", v, err)
+	}
+}
@@ -0,0 +1,95 @@
+// Counters telling how well the cache is doing.
+// They are updated with atomic operations, so reading them never
+// blocks the requests being counted
+package qecache
+
+import "sync/atomic"
+
+// A snapshot of the counters of a controller
+type Stats struct {
+	// every Get, including those from peers
+	Gets int64
+	// Gets served by either cache
+	CacheHits int64
+	// Gets that missed both caches
+	Loads int64
+	// Loads saved by singleflight: the caller got the result of a load
+	// of the same key already in flight, instead of running its own
+	LoadsDeduped int64
+	// values received from peers
+	PeerLoads int64
+	// failures to get a value from peers
+	PeerErrors int64
+	// values loaded by the fetcher
+	LocalLoads int64
+	// failures of the fetcher
+	LocalLoadErrs int64
+	// loads given up because the fetcher was over its limits
+	LoadsShed int64
+	// CacheHits that served a value past its expiration
+	StaleHits int64
+	// refreshes run in the background, see WithStaleWhileRevalidate
+	// and WithRefreshAhead
+	Refreshes int64
+}
+
+// the live counters behind Stats
+type controllerStats struct {
+	gets          atomic.Int64
+	cacheHits     atomic.Int64
+	loads         atomic.Int64
+	loadsDeduped  atomic.Int64
+	peerLoads     atomic.Int64
+	peerErrors    atomic.Int64
+	localLoads    atomic.Int64
+	localLoadErrs atomic.Int64
+	loadsShed     atomic.Int64
+	staleHits     atomic.Int64
+	refreshes     atomic.Int64
+}
+
+func (s *controllerStats) snapshot() Stats {
+	return Stats{
+		Gets:          s.gets.Load(),
+		CacheHits:     s.cacheHits.Load(),
+		Loads:         s.loads.Load(),
+		LoadsDeduped:  s.loadsDeduped.Load(),
+		PeerLoads:     s.peerLoads.Load(),
+		PeerErrors:    s.peerErrors.Load(),
+		LocalLoads:    s.localLoads.Load(),
+		LocalLoadErrs: s.localLoadErrs.Load(),
+		LoadsShed:     s.loadsShed.Load(),
+		StaleHits:     s.staleHits.Load(),
+		Refreshes:     s.refreshes.Load(),
+	}
+}
+
+// Which of the two caches of a controller
+type CacheType int
+
+const (
+	// the keys owned by the current node
+	MainCache CacheType = iota + 1
+	// the sample of keys owned by peers
+	HotCache
+)
+
+// A snapshot of the counters of one cache
+type CacheStats struct {
+	// how many bytes the keys and values take
+	Bytes int64
+	// how many entries are there
+	Items int64
+	Gets  int64
+	Hits  int64
+	// entries dropped by the eviction policy, or because they expired.
+	// Explicit removals are not counted
+	Evictions int64
+}
+
+// the live counters behind CacheStats, except those the policies know
+type cacheStats struct {
+	gets      atomic.Int64
+	hits      atomic.Int64
+	evictions atomic.Int64
+}
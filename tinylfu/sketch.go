@@ -0,0 +1,79 @@
+package tinylfu
+
+import "hash/fnv"
+
+// how many rows the count-min sketch has
+const SKETCH_DEPTH = 4
+
+// counters saturate here, just like the 4-bit counters of the paper
+const MAX_COUNT = 15
+
+// A count-min sketch estimating how often a key has been seen recently.
+// It only needs a few bits per key instead of remembering the keys.
+type sketch struct {
+	rows [SKETCH_DEPTH][]uint8
+	// width - 1, width is a power of 2 so that a mask replaces modulo
+	mask uint64
+	// how many increments since the last reset
+	additions int
+	// once additions reach it, every counter is halved.
+	// This ages old popularity so that the sketch follows the workload
+	sampleSize int
+}
+
+func newSketch(width int) *sketch {
+	w := 1
+	for w < width {
+		w <<= 1
+	}
+	s := &sketch{mask: uint64(w - 1), sampleSize: 10 * w}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+// derive one index per row from a single hash (double hashing)
+func (s *sketch) indexes(key string) [SKETCH_DEPTH]uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum, (sum>>32)|1
+
+	var idx [SKETCH_DEPTH]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *sketch) increment(key string) {
+	for i, idx := range s.indexes(key) {
+		if s.rows[i][idx] < MAX_COUNT {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.sampleSize {
+		s.reset()
+	}
+}
+
+// the smallest counter is the least overestimated one
+func (s *sketch) estimate(key string) uint8 {
+	est := uint8(MAX_COUNT)
+	for i, idx := range s.indexes(key) {
+		est = min(est, s.rows[i][idx])
+	}
+	return est
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
@@ -0,0 +1,253 @@
+/*
+Window TinyLFU eviction (Einziger, Friedman & Manes, 2017), measured in bytes.
+
+New entries enter a small LRU window. When an entry leaves the window it
+becomes a candidate for the main cache, a segmented LRU made of a
+probation and a protected part. The candidate is only admitted if a
+frequency sketch says it is more popular than the entry it would replace.
+*/
+package tinylfu
+
+import (
+	"QECache/eviction"
+	"container/list"
+	"time"
+)
+
+const (
+	// the window may take this fraction of maxBytes
+	WINDOW_RATIO = 0.01
+	// the protected part may take this fraction of the main cache
+	PROTECTED_RATIO = 0.8
+	// we assume entries take this many bytes on average to size the sketch
+	AVERAGE_ENTRY_BYTES = 64
+)
+
+// Simple W-TinyLFU data structure (dictionary). Not safe for concurrent access
+type TinyLFUDict struct {
+	// Give 0 for assuming infinite capacity
+	maxBytes int64
+	// the sizes of the window and of the protected part
+	windowBytes, protectedBytes  int64
+	window, probation, protected *segment
+	// every element of the three segments, indexed by key
+	cache map[string]*list.Element
+	// popularity of keys, including the ones not cached
+	freq *sketch
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value eviction.Value)
+	// the clock used to decide expiration. Replaceable for testing
+	now func() time.Time
+}
+
+type entry struct {
+	key    string
+	value  eviction.Value
+	expire time.Time
+	// the bytes the entry takes
+	size int64
+	// the segment holding the entry
+	seg *segment
+}
+
+// an LRU list keeping track of its bytes
+type segment struct {
+	ll    *list.List
+	bytes int64
+}
+
+func newSegment() *segment {
+	return &segment{ll: list.New()}
+}
+
+func (s *segment) pushFront(e *entry) *list.Element {
+	e.seg = s
+	s.bytes += e.size
+	return s.ll.PushFront(e)
+}
+
+func (s *segment) remove(ele *list.Element) *entry {
+	e := s.ll.Remove(ele).(*entry)
+	s.bytes -= e.size
+	return e
+}
+
+func New(maxBytes int64, onEvicted func(string, eviction.Value)) *TinyLFUDict {
+	width := 1 << 16
+	if maxBytes != 0 {
+		width = int(min(max(maxBytes/AVERAGE_ENTRY_BYTES, 256), 1<<20))
+	}
+	mainBytes := maxBytes - int64(float64(maxBytes)*WINDOW_RATIO)
+	return &TinyLFUDict{
+		maxBytes:       maxBytes,
+		windowBytes:    int64(float64(maxBytes) * WINDOW_RATIO),
+		protectedBytes: int64(float64(mainBytes) * PROTECTED_RATIO),
+		window:         newSegment(),
+		probation:      newSegment(),
+		protected:      newSegment(),
+		cache:          make(map[string]*list.Element),
+		freq:           newSketch(width),
+		OnEvicted:      onEvicted,
+		now:            time.Now,
+	}
+}
+
+func (c *TinyLFUDict) Get(key string) (value eviction.Value, ok bool) {
+	// misses count as well, a key requested often deserves admission
+	c.freq.increment(key)
+
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	e := ele.Value.(*entry)
+	if eviction.Expired(e.expire, c.now()) {
+		c.removeElement(ele)
+		return nil, false
+	}
+
+	switch e.seg {
+	case c.probation:
+		// accessed again while on probation, it deserves protection
+		c.probation.remove(ele)
+		c.cache[key] = c.protected.pushFront(e)
+		c.demote()
+	default:
+		e.seg.ll.MoveToFront(ele)
+	}
+	return e.value, true
+}
+
+func (c *TinyLFUDict) Add(key string, value eviction.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+func (c *TinyLFUDict) AddWithTTL(key string, value eviction.Value, ttl time.Duration) {
+	e := &entry{
+		key:    key,
+		value:  value,
+		expire: eviction.ExpireAt(c.now(), ttl),
+		size:   int64(len(key)) + int64(value.Len()),
+	}
+
+	target := c.window
+	if ele, ok := c.cache[key]; ok {
+		// an update stays where it was
+		old := ele.Value.(*entry)
+		target = old.seg
+		old.seg.remove(ele)
+	} else {
+		c.freq.increment(key)
+	}
+	c.cache[key] = target.pushFront(e)
+
+	c.demote()
+	c.drainWindow()
+	for c.maxBytes != 0 && c.UsedBytes() > c.maxBytes && c.Len() > 1 {
+		c.RemoveOldest()
+	}
+}
+
+// keep protected within its share by moving its LRU back to probation
+func (c *TinyLFUDict) demote() {
+	for c.maxBytes != 0 && c.protected.bytes > c.protectedBytes && c.protected.ll.Len() > 1 {
+		e := c.protected.remove(c.protected.ll.Back())
+		c.cache[e.key] = c.probation.pushFront(e)
+	}
+}
+
+// move entries overflowing the window into the main cache, if admitted
+func (c *TinyLFUDict) drainWindow() {
+	for c.maxBytes != 0 && c.window.bytes > c.windowBytes && c.window.ll.Len() > 0 {
+		candidate := c.window.remove(c.window.ll.Back())
+		delete(c.cache, candidate.key)
+		// A window too small for the entry just added, e.g. 1% of a
+		// budget under 100 bytes, drains it at once. It never had the
+		// time to be used again, so it wins the ties: otherwise a full
+		// cache of keys seen once would never take a new key
+		fresh := c.window.ll.Len() == 0
+		c.admit(candidate, fresh)
+	}
+}
+
+// The TinyLFU admission policy.
+// The candidate fights the victims of the main cache one by one
+// until there is room, the less popular one leaves.
+// A tie goes to the victim, unless the candidate is fresh
+func (c *TinyLFUDict) admit(candidate *entry, fresh bool) {
+	mainMax := c.maxBytes - c.windowBytes
+	for c.probation.bytes+c.protected.bytes+candidate.size > mainMax {
+		victims := c.probation
+		if victims.ll.Len() == 0 {
+			victims = c.protected
+		}
+		victim := victims.ll.Back()
+		if victim == nil {
+			break
+		}
+
+		estimate, victimEstimate := c.freq.estimate(candidate.key), c.freq.estimate(victim.Value.(*entry).key)
+		if estimate < victimEstimate || (estimate == victimEstimate && !fresh) {
+			// rejected
+			if c.OnEvicted != nil {
+				c.OnEvicted(candidate.key, candidate.value)
+			}
+			return
+		}
+		c.removeElement(victim)
+	}
+	c.cache[candidate.key] = c.probation.pushFront(candidate)
+}
+
+func (c *TinyLFUDict) Remove(key string) bool {
+	if ele, ok := c.cache[key]; ok {
+		c.removeElement(ele)
+		return true
+	}
+	return false
+}
+
+// Probation holds the entries the policy values the least
+func (c *TinyLFUDict) RemoveOldest() {
+	for _, s := range []*segment{c.probation, c.window, c.protected} {
+		if ele := s.ll.Back(); ele != nil {
+			c.removeElement(ele)
+			return
+		}
+	}
+}
+
+func (c *TinyLFUDict) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, s := range []*segment{c.window, c.probation, c.protected} {
+		for ele := s.ll.Back(); ele != nil; {
+			prev := ele.Prev()
+			if eviction.Expired(ele.Value.(*entry).expire, now) {
+				c.removeElement(ele)
+				removed++
+			}
+			ele = prev
+		}
+	}
+	return removed
+}
+
+func (c *TinyLFUDict) removeElement(ele *list.Element) {
+	e := ele.Value.(*entry)
+	e.seg.remove(ele)
+	delete(c.cache, e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+func (c *TinyLFUDict) Len() int {
+	return c.window.ll.Len() + c.probation.ll.Len() + c.protected.ll.Len()
+}
+
+func (c *TinyLFUDict) UsedBytes() int64 {
+	return c.window.bytes + c.probation.bytes + c.protected.bytes
+}
+
+var _ eviction.Policy = (*TinyLFUDict)(nil)
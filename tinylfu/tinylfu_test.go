@@ -0,0 +1,72 @@
+package tinylfu
+
+import (
+	"fmt"
+	"testing"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestSketch(t *testing.T) {
+	s := newSketch(64)
+	for i := 0; i < 5; i++ {
+		s.increment("hot")
+	}
+	s.increment("cold")
+	if s.estimate("hot") < 5 || s.estimate("hot") <= s.estimate("cold") {
+		t.Fatalf("hot should be estimated more popular than cold")
+	}
+
+	s.reset()
+	if s.estimate("hot") != 2 {
+		t.Fatalf("reset should halve the counters, got %d", s.estimate("hot"))
+	}
+}
+
+func TestAdmission(t *testing.T) {
+	// room for 10 entries
+	c := New(int64(10*len("k0v")), nil)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		c.Add(key, String("v"))
+		for j := 0; j < 3; j++ {
+			c.Get(key)
+		}
+	}
+
+	// keys seen once lose against the popular ones
+	for i := 0; i < 100; i++ {
+		c.Add(fmt.Sprintf("s%d", i), String("v"))
+	}
+
+	kept := 0
+	for i := 0; i < 10; i++ {
+		if _, ok := c.Get(fmt.Sprintf("k%d", i)); ok {
+			kept++
+		}
+	}
+	if kept < 9 {
+		t.Fatalf("popular keys should not be replaced by a scan, kept %d", kept)
+	}
+}
+
+func TestSmallBudget(t *testing.T) {
+	// the window would be 1% of 50 bytes, rounded down to nothing
+	c := New(50, nil)
+	for i := 0; i < 10; i++ {
+		c.Add(fmt.Sprintf("k%d", i), String("12345678"))
+	}
+	if c.UsedBytes() > 50 {
+		t.Fatalf("the cache should stay within its budget, got %d bytes", c.UsedBytes())
+	}
+
+	// a full cache still takes new keys
+	c.Add("new", String("1234567"))
+	if _, ok := c.Get("new"); !ok {
+		t.Fatalf("a new key should get into a full cache")
+	}
+}
@@ -0,0 +1,91 @@
+// Helpers for the transports between peers: they convert the results
+// of lookups to the wire envelopes and back, errors included.
+// HTTPServer uses them, so can transports outside of this package such
+// as grpctransport
+package qecache
+
+import (
+	"QECache/wire"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Convert the result of a lookup into the envelope
+func ResponseOfView(view ByteView, err error) *wire.Response {
+	if errors.Is(err, ErrNotFound) {
+		return &wire.Response{Status: wire.StatusNotFound, Error: err.Error()}
+	}
+	if errors.Is(err, ErrLoadShed) {
+		return &wire.Response{Status: wire.StatusLoadShed, Error: err.Error()}
+	}
+	if err != nil {
+		return &wire.Response{Status: wire.StatusError, Error: err.Error()}
+	}
+	msg := &wire.Response{Status: wire.StatusOK, Value: view.value}
+	if !view.expire.IsZero() {
+		msg.Expire = view.expire.UnixNano()
+	}
+	return msg
+}
+
+// Convert the envelope back into the result of a lookup
+func ViewOfResponse(msg *wire.Response) (ByteView, error) {
+	switch msg.Status {
+	case wire.StatusOK:
+		view := ByteView{value: msg.Value}
+		if msg.Expire != 0 {
+			view.expire = time.Unix(0, msg.Expire)
+		}
+		return view, nil
+	case wire.StatusNotFound:
+		return ByteView{}, &remoteError{msg: msg.Error, sentinel: ErrNotFound}
+	case wire.StatusLoadShed:
+		return ByteView{}, &remoteError{msg: msg.Error, sentinel: ErrLoadShed}
+	default:
+		return ByteView{}, fmt.Errorf("API error: %v", msg.Error)
+	}
+}
+
+// An answer of a peer that means one of our errors, e.g. ErrNotFound.
+// It reads as the message of the peer and matches the error with errors.Is
+type remoteError struct {
+	msg      string
+	sentinel error
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Is(target error) bool {
+	return target == e.sentinel
+}
+
+// Convert the results of a lookup of many keys into the envelope,
+// one answer per key in the order they were asked
+func BatchOfResults(keys []string, results map[string]LookupResult) *wire.BatchResponse {
+	msg := &wire.BatchResponse{Responses: make([]wire.Response, len(keys))}
+	for i, key := range keys {
+		res := results[key]
+		msg.Responses[i] = *ResponseOfView(res.Value, res.Err)
+		msg.Responses[i].Key = key
+	}
+	return msg
+}
+
+// Convert the envelope back into the results of a lookup of many keys.
+// A peer answering about other keys is broken, all of it is rejected
+func ResultsOfBatch(keys []string, msg *wire.BatchResponse) ([]LookupResult, error) {
+	if len(msg.Responses) != len(keys) {
+		return nil, fmt.Errorf("bad response: %d answers for %d keys", len(msg.Responses), len(keys))
+	}
+	results := make([]LookupResult, len(keys))
+	for i := range msg.Responses {
+		if msg.Responses[i].Key != keys[i] {
+			return nil, fmt.Errorf("bad response: answer about %q instead of %q", msg.Responses[i].Key, keys[i])
+		}
+		results[i].Value, results[i].Err = ViewOfResponse(&msg.Responses[i])
+	}
+	return results, nil
+}
@@ -0,0 +1,215 @@
+/*
+Full 2Q eviction (Johnson & Shasha, 1994), measured in bytes.
+
+A new key first lands in the FIFO a1in. If it is evicted from there,
+its key is remembered in the ghost FIFO a1out. Only a key that comes back
+while it is still remembered is considered hot and enters the LRU am.
+A one-off scan therefore never pushes hot entries out of am.
+*/
+package twoq
+
+import (
+	"QECache/eviction"
+	"container/list"
+	"time"
+)
+
+const (
+	// a1in may take this fraction of maxBytes
+	IN_RATIO = 0.25
+	// a1out remembers keys worth this fraction of maxBytes
+	OUT_RATIO = 0.5
+)
+
+// Simple 2Q data structure (dictionary). Not safe for concurrent access
+type TwoQDict struct {
+	// Give 0 for assuming infinite capacity
+	maxBytes int64
+	// the sizes of a1in and a1out, derived from maxBytes
+	inBytes, outBytes int64
+	// the FIFO of new entries, the ghost FIFO and the main LRU
+	a1in, a1out, am *segment
+	// every element of the three segments, indexed by key
+	cache map[string]*list.Element
+	// optional and executed when an entry is purged.
+	OnEvicted func(key string, value eviction.Value)
+	// the clock used to decide expiration. Replaceable for testing
+	now func() time.Time
+}
+
+type entry struct {
+	key    string
+	value  eviction.Value
+	expire time.Time
+	// the bytes the entry takes (or took, for a ghost)
+	size int64
+	// the segment holding the entry
+	seg *segment
+}
+
+// a list keeping track of its bytes
+type segment struct {
+	ll    *list.List
+	bytes int64
+}
+
+func newSegment() *segment {
+	return &segment{ll: list.New()}
+}
+
+func (s *segment) pushFront(e *entry) *list.Element {
+	e.seg = s
+	s.bytes += e.size
+	return s.ll.PushFront(e)
+}
+
+func (s *segment) remove(ele *list.Element) *entry {
+	e := s.ll.Remove(ele).(*entry)
+	s.bytes -= e.size
+	return e
+}
+
+func New(maxBytes int64, onEvicted func(string, eviction.Value)) *TwoQDict {
+	return &TwoQDict{
+		maxBytes:  maxBytes,
+		inBytes:   int64(float64(maxBytes) * IN_RATIO),
+		outBytes:  int64(float64(maxBytes) * OUT_RATIO),
+		a1in:      newSegment(),
+		a1out:     newSegment(),
+		am:        newSegment(),
+		cache:     make(map[string]*list.Element),
+		OnEvicted: onEvicted,
+		now:       time.Now,
+	}
+}
+
+func (c *TwoQDict) Get(key string) (value eviction.Value, ok bool) {
+	ele, ok := c.cache[key]
+	if !ok {
+		return
+	}
+	e := ele.Value.(*entry)
+	if e.seg == c.a1out {
+		// a ghost only remembers the key
+		return nil, false
+	}
+	if eviction.Expired(e.expire, c.now()) {
+		c.removeElement(ele)
+		return nil, false
+	}
+
+	// a1in is a FIFO on purpose: a second access shortly after the first
+	// one is usually correlated and does not make the entry hot
+	if e.seg == c.am {
+		c.am.ll.MoveToFront(ele)
+	}
+	return e.value, true
+}
+
+func (c *TwoQDict) Add(key string, value eviction.Value) {
+	c.AddWithTTL(key, value, 0)
+}
+
+func (c *TwoQDict) AddWithTTL(key string, value eviction.Value, ttl time.Duration) {
+	e := &entry{
+		key:    key,
+		value:  value,
+		expire: eviction.ExpireAt(c.now(), ttl),
+		size:   int64(len(key)) + int64(value.Len()),
+	}
+
+	target := c.a1in
+	if ele, ok := c.cache[key]; ok {
+		old := ele.Value.(*entry)
+		old.seg.remove(ele)
+		delete(c.cache, key)
+		switch old.seg {
+		case c.a1out:
+			// it came back while remembered, so it is hot
+			target = c.am
+		default:
+			// an update stays where it was
+			target = old.seg
+		}
+	}
+
+	c.reclaim(e.size)
+	c.cache[key] = target.pushFront(e)
+}
+
+// make room for `size` more bytes
+func (c *TwoQDict) reclaim(size int64) {
+	for c.maxBytes != 0 && c.UsedBytes()+size > c.maxBytes && c.Len() > 0 {
+		c.RemoveOldest()
+	}
+}
+
+func (c *TwoQDict) RemoveOldest() {
+	if c.a1in.ll.Len() > 0 && (c.a1in.bytes > c.inBytes || c.am.ll.Len() == 0) {
+		e := c.a1in.remove(c.a1in.ll.Back())
+		if c.OnEvicted != nil {
+			c.OnEvicted(e.key, e.value)
+		}
+		// keep the key only, in case it comes back
+		e.value = nil
+		c.cache[e.key] = c.a1out.pushFront(e)
+		for c.a1out.ll.Len() > 0 && c.a1out.bytes > c.outBytes {
+			delete(c.cache, c.a1out.remove(c.a1out.ll.Back()).key)
+		}
+		return
+	}
+	if ele := c.am.ll.Back(); ele != nil {
+		c.removeElement(ele)
+	}
+}
+
+func (c *TwoQDict) Remove(key string) bool {
+	ele, ok := c.cache[key]
+	if !ok {
+		return false
+	}
+	if ele.Value.(*entry).seg == c.a1out {
+		// forget the ghost as well, the key is not wanted anymore
+		c.a1out.remove(ele)
+		delete(c.cache, key)
+		return false
+	}
+	c.removeElement(ele)
+	return true
+}
+
+func (c *TwoQDict) RemoveExpired() int {
+	now := c.now()
+	removed := 0
+	for _, s := range []*segment{c.a1in, c.am} {
+		for ele := s.ll.Back(); ele != nil; {
+			prev := ele.Prev()
+			if eviction.Expired(ele.Value.(*entry).expire, now) {
+				c.removeElement(ele)
+				removed++
+			}
+			ele = prev
+		}
+	}
+	return removed
+}
+
+// drop a resident entry without leaving a ghost behind
+func (c *TwoQDict) removeElement(ele *list.Element) {
+	e := ele.Value.(*entry)
+	e.seg.remove(ele)
+	delete(c.cache, e.key)
+	if c.OnEvicted != nil {
+		c.OnEvicted(e.key, e.value)
+	}
+}
+
+func (c *TwoQDict) Len() int {
+	return c.a1in.ll.Len() + c.am.ll.Len()
+}
+
+func (c *TwoQDict) UsedBytes() int64 {
+	return c.a1in.bytes + c.am.bytes
+}
+
+var _ eviction.Policy = (*TwoQDict)(nil)
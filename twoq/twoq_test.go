@@ -0,0 +1,37 @@
+package twoq
+
+import (
+	"fmt"
+	"testing"
+)
+
+type String string
+
+func (d String) Len() int {
+	return len(d)
+}
+
+func TestPromoteFromGhost(t *testing.T) {
+	// room for 8 entries, a1in takes 2 of them
+	q := New(int64(8*len("k0v")), nil)
+	for i := 0; i < 9; i++ {
+		q.Add(fmt.Sprintf("k%d", i), String("v"))
+	}
+
+	// k0 left a1in and is remembered in a1out
+	if _, ok := q.Get("k0"); ok {
+		t.Fatalf("k0 should be evicted")
+	}
+	q.Add("k0", String("v"))
+	if ele := q.cache["k0"]; ele.Value.(*entry).seg != q.am {
+		t.Fatalf("k0 came back while remembered and should enter am")
+	}
+
+	// a scan only churns a1in, k0 stays in am
+	for i := 0; i < 100; i++ {
+		q.Add(fmt.Sprintf("s%d", i), String("v"))
+	}
+	if _, ok := q.Get("k0"); !ok {
+		t.Fatalf("hot key k0 should survive a scan")
+	}
+}
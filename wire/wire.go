@@ -0,0 +1,291 @@
+/*
+The binary format spoken between peers.
+
+A message starts with one version byte, followed by fields.
+Each field is a uvarint tag, a uvarint length and that many bytes,
+a bit like protobuf. A decoder skips the tags it does not know, so newer
+peers can add fields without breaking older ones.
+
+Peers negotiate it with HTTP headers: a client lists CONTENT_TYPE in
+Accept, and a server that knows it answers with the same Content-Type.
+Old servers answer with the raw value as application/octet-stream.
+*/
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The media type of the messages
+const CONTENT_TYPE = "application/vnd.qecache.v1"
+
+// The version written in the first byte of every message.
+// A decoder rejects messages of a newer version, and 0 which no encoder
+// ever wrote, e.g. a zeroed buffer
+const VERSION = 1
+
+// The outcome of a lookup
+type Status uint8
+
+const (
+	StatusOK Status = iota
+	// the fetcher says the key does not exist
+	StatusNotFound
+	// any other failure, see Response.Error
+	StatusError
+	// the peer was too busy to fetch the key. Older peers read it as
+	// StatusError
+	StatusLoadShed
+)
+
+// field tags of Response. Never reuse a tag once released
+const (
+	tagStatus = 1
+	tagValue  = 2
+	tagExpire = 3
+	tagError  = 4
+	tagKey    = 5
+)
+
+// The answer to a lookup
+type Response struct {
+	// which key it is about. Optional for a single lookup
+	Key    string
+	Status Status
+	Value  []byte
+	// expiration time in unix nanoseconds, 0 means never
+	Expire int64
+	// what went wrong when Status is not StatusOK
+	Error string
+}
+
+// field tags of Request. Never reuse a tag once released
+const (
+	tagNamespace = 1
+	tagReqKey    = 2
+	tagReqValue  = 3
+	tagReqExpire = 4
+)
+
+// A request about one key, used by transports that need a request body
+type Request struct {
+	// the name of the controller
+	Namespace string
+	Key       string
+	// the value to store, only for a set
+	Value []byte
+	// expiration time of Value in unix nanoseconds, 0 means never
+	Expire int64
+}
+
+// field tags of BatchRequest. Never reuse a tag once released
+const (
+	tagBatchNamespace = 1
+	// repeated, once per key
+	tagBatchKey = 2
+)
+
+// A lookup of many keys of the same controller at once
+type BatchRequest struct {
+	Namespace string
+	Keys      []string
+}
+
+// field tags of BatchResponse. Never reuse a tag once released
+const (
+	// repeated, each one a whole Response message
+	tagBatchResponse = 1
+)
+
+// The answers to a BatchRequest, one per key in the same order.
+// Each one tells its Key
+type BatchResponse struct {
+	Responses []Response
+}
+
+var ErrMalformed = errors.New("malformed message")
+
+func (r *Request) MarshalBinary() ([]byte, error) {
+	b := []byte{VERSION}
+	b = appendField(b, tagNamespace, []byte(r.Namespace))
+	b = appendField(b, tagReqKey, []byte(r.Key))
+	if len(r.Value) > 0 {
+		b = appendField(b, tagReqValue, r.Value)
+	}
+	if r.Expire != 0 {
+		b = appendVarintField(b, tagReqExpire, r.Expire)
+	}
+	return b, nil
+}
+
+func (r *Request) UnmarshalBinary(data []byte) error {
+	*r = Request{}
+	return decode(data, func(tag uint64, field []byte) error {
+		switch tag {
+		case tagNamespace:
+			r.Namespace = string(field)
+		case tagReqKey:
+			r.Key = string(field)
+		case tagReqValue:
+			r.Value = append([]byte(nil), field...)
+		case tagReqExpire:
+			v, n := binary.Varint(field)
+			if n <= 0 {
+				return ErrMalformed
+			}
+			r.Expire = v
+		}
+		return nil
+	})
+}
+
+func (r *Response) MarshalBinary() ([]byte, error) {
+	b := []byte{VERSION}
+	b = appendUvarintField(b, tagStatus, uint64(r.Status))
+	if r.Key != "" {
+		b = appendField(b, tagKey, []byte(r.Key))
+	}
+	if len(r.Value) > 0 {
+		b = appendField(b, tagValue, r.Value)
+	}
+	if r.Expire != 0 {
+		b = appendVarintField(b, tagExpire, r.Expire)
+	}
+	if r.Error != "" {
+		b = appendField(b, tagError, []byte(r.Error))
+	}
+	return b, nil
+}
+
+func (r *Response) UnmarshalBinary(data []byte) error {
+	*r = Response{}
+	return decode(data, func(tag uint64, field []byte) error {
+		switch tag {
+		case tagStatus:
+			v, err := uvarint(field)
+			r.Status = Status(v)
+			return err
+		case tagKey:
+			r.Key = string(field)
+		case tagValue:
+			// copy so that the message buffer can be reused
+			r.Value = append([]byte(nil), field...)
+		case tagExpire:
+			v, n := binary.Varint(field)
+			if n <= 0 {
+				return ErrMalformed
+			}
+			r.Expire = v
+		case tagError:
+			r.Error = string(field)
+		}
+		// unknown tags are skipped
+		return nil
+	})
+}
+
+func (r *BatchRequest) MarshalBinary() ([]byte, error) {
+	b := []byte{VERSION}
+	b = appendField(b, tagBatchNamespace, []byte(r.Namespace))
+	for _, key := range r.Keys {
+		b = appendField(b, tagBatchKey, []byte(key))
+	}
+	return b, nil
+}
+
+func (r *BatchRequest) UnmarshalBinary(data []byte) error {
+	*r = BatchRequest{}
+	return decode(data, func(tag uint64, field []byte) error {
+		switch tag {
+		case tagBatchNamespace:
+			r.Namespace = string(field)
+		case tagBatchKey:
+			r.Keys = append(r.Keys, string(field))
+		}
+		return nil
+	})
+}
+
+func (r *BatchResponse) MarshalBinary() ([]byte, error) {
+	b := []byte{VERSION}
+	for i := range r.Responses {
+		// nested messages keep their own version byte, so that they
+		// decode the same as a single Response
+		field, err := r.Responses[i].MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		b = appendField(b, tagBatchResponse, field)
+	}
+	return b, nil
+}
+
+func (r *BatchResponse) UnmarshalBinary(data []byte) error {
+	*r = BatchResponse{}
+	return decode(data, func(tag uint64, field []byte) error {
+		if tag != tagBatchResponse {
+			return nil
+		}
+		var res Response
+		if err := res.UnmarshalBinary(field); err != nil {
+			return err
+		}
+		r.Responses = append(r.Responses, res)
+		return nil
+	})
+}
+
+// Walk through the fields of a message
+func decode(data []byte, onField func(tag uint64, field []byte) error) error {
+	if len(data) == 0 {
+		return ErrMalformed
+	}
+	if data[0] < 1 || data[0] > VERSION {
+		return fmt.Errorf("unsupported version %d: %w", data[0], ErrMalformed)
+	}
+	data = data[1:]
+
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		data = data[n:]
+
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return ErrMalformed
+		}
+		field := data[n : n+int(length)]
+		data = data[n+int(length):]
+
+		if err := onField(tag, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendField(b []byte, tag uint64, field []byte) []byte {
+	b = binary.AppendUvarint(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+func appendUvarintField(b []byte, tag uint64, v uint64) []byte {
+	return appendField(b, tag, binary.AppendUvarint(nil, v))
+}
+
+func appendVarintField(b []byte, tag uint64, v int64) []byte {
+	return appendField(b, tag, binary.AppendVarint(nil, v))
+}
+
+func uvarint(field []byte) (uint64, error) {
+	v, n := binary.Uvarint(field)
+	if n <= 0 {
+		return 0, ErrMalformed
+	}
+	return v, nil
+}
@@ -0,0 +1,96 @@
+package wire
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestResponseRoundTrip(t *testing.T) {
+	for _, r := range []Response{
+		{Status: StatusOK, Value: []byte("630"), Expire: 1700000000000000000},
+		{Key: "Tom", Status: StatusOK, Value: []byte("630")},
+		{Status: StatusNotFound},
+		{Status: StatusError, Error: "boom"},
+	} {
+		b, err := r.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Response
+		if err := decoded.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, decoded) {
+			t.Fatalf("expect %+v, got %+v", r, decoded)
+		}
+	}
+}
+
+func TestSkipUnknownField(t *testing.T) {
+	r := Response{Value: []byte("630")}
+	b, _ := r.MarshalBinary()
+	// a field added by a newer peer
+	b = appendField(b, 99, []byte("whatever"))
+
+	var decoded Response
+	if err := decoded.UnmarshalBinary(b); err != nil || string(decoded.Value) != "630" {
+		t.Fatalf("unknown fields should be skipped, err %v", err)
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		{VERSION + 1},
+		// no version was ever 0
+		{0},
+		{0, tagValue, 1, 'a'},
+		// the length goes beyond the message
+		{VERSION, tagValue, 10, 'a'},
+	} {
+		var r Response
+		if err := r.UnmarshalBinary(b); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%v should be rejected as malformed, got %v", b, err)
+		}
+	}
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, r := range []Request{
+		{Namespace: "scores", Key: "Tom"},
+		{Namespace: "scores", Key: "Tom", Value: []byte("630"), Expire: 1700000000000000000},
+	} {
+		b, _ := r.MarshalBinary()
+		var decoded Request
+		if err := decoded.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(decoded, r) {
+			t.Fatalf("expect %+v, got %+v, %v", r, decoded, err)
+		}
+	}
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	req := BatchRequest{Namespace: "scores", Keys: []string{"Tom", "Jack", "Sam"}}
+	b, _ := req.MarshalBinary()
+	var decodedReq BatchRequest
+	if err := decodedReq.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(decodedReq, req) {
+		t.Fatalf("expect %+v, got %+v, %v", req, decodedReq, err)
+	}
+
+	res := BatchResponse{Responses: []Response{
+		{Key: "Tom", Status: StatusOK, Value: []byte("630"), Expire: 1700000000000000000},
+		{Key: "Jack", Status: StatusNotFound, Error: "Jack not exist"},
+		{Key: "Sam", Status: StatusOK, Value: []byte("567")},
+	}}
+	b, _ = res.MarshalBinary()
+	var decodedRes BatchResponse
+	if err := decodedRes.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(decodedRes, res) {
+		t.Fatalf("expect %+v, got %+v, %v", res, decodedRes, err)
+	}
+
+	// a broken answer inside breaks the batch
+	b = appendField([]byte{VERSION}, tagBatchResponse, []byte{VERSION, tagValue, 10})
+	if err := decodedRes.UnmarshalBinary(b); err == nil {
+		t.Fatal("malformed nested responses should be rejected")
+	}
+}